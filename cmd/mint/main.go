@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/mandrigin/turbo-api-examples/metric"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/utils"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
-	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/ledgerwatch/turbo-geth/turbo/node"
 
@@ -17,67 +19,64 @@ import (
 var (
 	outputFileNameFlag = cli.StringFlag{
 		Name:  "output",
+		Usage: "The CSV file to append the values to",
 		Value: "mint.csv",
 	}
 
-	blockNumberFlag = cli.Int64Flag{
+	blockNumberFlag = cli.Uint64Flag{
 		Name:  "block",
-		Value: 0,
+		Usage: "The first block to export (the blocks that are already in the file are skipped)",
 	}
 
-	stageID = stages.SyncStage("org.ffconsulting.AVG_GAS_PRICE")
+	// metrics are calculated by the node
+	metrics = []metric.BlockMetric{metric.AverageGasPrice{}}
+
+	commands = []cli.Command{
+		{
+			Name:   "export",
+			Usage:  "Write the cumulative gas used and the average gas price calculated by the node to a CSV file",
+			Flags:  []cli.Flag{utils.DataDirFlag, outputFileNameFlag, blockNumberFlag},
+			Action: export,
+		},
+	}
 )
 
 func main() {
-	app := turbocli.MakeApp(runTurboGeth, append(turbocli.DefaultFlags, outputFileNameFlag, blockNumberFlag))
+	app := turbocli.MakeApp(runTurboGeth, turbocli.DefaultFlags)
+	app.Commands = commands
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func syncStages(ctx *cli.Context) stagedsync.StageBuilders {
-	return append(
-		stagedsync.DefaultStages(),
-		stagedsync.StageBuilder{
-			ID: stageID,
-			Build: func(world stagedsync.StageParameters) *stagedsync.Stage {
-				return &stagedsync.Stage{
-					ID:          stageID,
-					Description: "Plot Minted Coins",
-					ExecFunc: func(s *stagedsync.StageState, _ stagedsync.Unwinder) error {
-						fileName := ctx.String(outputFileNameFlag.Name)
-						if fileName == "" {
-							fileName = "mint.csv"
-						}
-
-						blockNumber := ctx.Uint64(blockNumberFlag.Name)
-
-						err := mint(world.TX, fileName, blockNumber)
-						if err != nil {
-							return err
-						}
-
-						s.Done()
-						return nil
-					},
-
-					UnwindFunc: func(u *stagedsync.UnwindState, s *stagedsync.StageState) error {
-						return u.Done(world.TX)
-					},
-				}
-			},
-		},
-	)
+func syncStages() (stagedsync.StageBuilders, stagedsync.UnwindOrder) {
+	defaultStages := stagedsync.DefaultStages()
+	builders := append(defaultStages, metric.SyncStages(metrics)...)
+
+	unwindOrder := stagedsync.DefaultUnwindOrder()
+	for i := len(defaultStages); i < len(builders); i++ {
+		unwindOrder = append(unwindOrder, i)
+	}
+
+	return builders, unwindOrder
 }
 
 func runTurboGeth(ctx *cli.Context) {
+	stages, unwindOrder := syncStages()
+
 	sync := stagedsync.New(
-		syncStages(ctx),
-		stagedsync.DefaultUnwindOrder(),
+		stages,
+		unwindOrder,
+		stagedsync.OptionalParameters{},
 	)
 
-	tg := node.New(ctx, sync, node.Params{})
+	// Adding custom buckets where we will store the metric values per block
+	params := node.Params{
+		CustomBuckets: metric.Buckets(metrics),
+	}
+
+	tg := node.New(ctx, sync, params)
 
 	err := tg.Serve()
 
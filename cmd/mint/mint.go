@@ -2,161 +2,131 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
-	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/mandrigin/turbo-api-examples/metric"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/utils"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
-	"github.com/ledgerwatch/turbo-geth/core/rawdb"
-	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
-	"github.com/ledgerwatch/turbo-geth/rlp"
 
-	"github.com/holiman/uint256"
+	"github.com/urfave/cli"
 )
 
-func readBlockNumberFromFile(f *os.File) uint64 {
+// readBlockNumberFromFile returns the block of the last line in the CSV file, `ok` is false if the file is empty.
+func readBlockNumberFromFile(f *os.File) (blockNumber uint64, ok bool, err error) {
 	csvReader := csv.NewReader(f)
-	previousLine := []string{}
+	csvReader.TrimLeadingSpace = true
+	var previousLine []string
 
 	for {
 		line, err := csvReader.Read()
 		if err == io.EOF {
-			if len(previousLine) == 0 {
-				log.Error("No fields found in the line")
-				return 0
-			}
-			numberString := previousLine[0]
-			number, err := strconv.ParseInt(numberString, 10, 64)
-			if err != nil {
-				log.Error("Error parsing block number", "numberString", numberString, "err", err)
-				return 0
-			}
-			return uint64(number)
-		} else if err != nil {
-			log.Error("Something happenned during reading", "err", err)
-			return 0
+			break
+		}
+		if err != nil {
+			return 0, false, err
 		}
 		previousLine = line
 	}
+
+	if len(previousLine) == 0 {
+		return 0, false, nil
+	}
+
+	blockNumber, err = strconv.ParseUint(previousLine[0], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("can't parse the block number %q: %w", previousLine[0], err)
+	}
+	return blockNumber, true, nil
 }
 
-func mint(db ethdb.Database, csvPath string, block uint64) error {
+// export appends the values of the average gas price metric stored by the node to the CSV file:
+// the block number, the total gas used up to the block and the average gas price (in gwei).
+func export(ctx *cli.Context) error {
+	csvPath := ctx.String(outputFileNameFlag.Name)
 	if !strings.HasSuffix(csvPath, ".csv") {
 		csvPath += ".csv"
 	}
 
-	log.Info("plotting minted coins", "block", block, "file", csvPath)
-
-	f, err := os.OpenFile(csvPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0777)
+	f, err := os.OpenFile(csvPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	blockNumberFromFile := readBlockNumberFromFile(f)
-
-	if blockNumberFromFile > block {
+	block := ctx.Uint64(blockNumberFlag.Name)
+	blockNumberFromFile, ok, err := readBlockNumberFromFile(f)
+	if err != nil {
+		return err
+	}
+	if ok && blockNumberFromFile >= block {
 		block = blockNumberFromFile + 1 // we want the next block
 	}
 
-	f.Seek(0, 0) // reset to the beginning
-
-	defer func() {
-		fmt.Println("closed", csvPath)
-		f.Close()
-	}()
-
-	w := bufio.NewWriter(f)
-	defer func() {
-		w.Flush()
-		fmt.Println("flushed", csvPath)
-	}()
-
-	var gwei uint256.Int
-	gwei.SetUint64(1000000000)
-	blockEncoded := dbutils.EncodeBlockNumber(block)
-	canonical := make(map[common.Hash]struct{})
-
-	err = db.Walk(dbutils.HeaderPrefix, blockEncoded, 0, func(k, v []byte) (bool, error) {
-		if !dbutils.CheckCanonicalKey(k) {
-			return true, nil
-		}
-		canonical[common.BytesToHash(v)] = struct{}{}
-		return true, nil
-	})
+	db, err := openDatabase(ctx)
 	if err != nil {
 		return err
 	}
+	defer db.Close()
 
-	log.Info("minted coins: canonical hashes", "count", len(canonical))
-
-	var prevBlock uint64
-	var burntGas uint64
+	m := metric.AverageGasPrice{}
+	calculatedAt, err := stages.GetStageProgress(db, metric.StageID(m))
+	if err != nil {
+		return err
+	}
 
-	log.Info("walking through block bodies", "fromBlock", block)
+	log.Info("Exporting "+m.Name(), "from", block, "to", calculatedAt, "file", csvPath)
 
-	err = db.Walk(dbutils.BlockBodyPrefix, blockEncoded, 0, func(k, v []byte) (bool, error) {
-		blockNumber := binary.BigEndian.Uint64(k[:8])
-		blockHash := common.BytesToHash(k[8:])
-		if _, isCanonical := canonical[blockHash]; !isCanonical {
-			return true, nil
-		}
+	w := bufio.NewWriter(f)
 
-		if blockNumber != prevBlock && blockNumber != prevBlock+1 {
-			fmt.Printf("Gap [%d-%d]\n", prevBlock, blockNumber-1)
+	err = db.Walk(metric.BucketName(m), dbutils.EncodeBlockNumber(block), 0, func(k, v []byte) (bool, error) {
+		blockNumber := binary.BigEndian.Uint64(k)
+		if blockNumber > calculatedAt {
+			return false, nil
 		}
 
-		if blockNumber%1000 == 0 {
-			log.Info("walking through block bodies", "fromBlock", block, "current", blockNumber)
+		var value metric.GasPrice
+		if err := json.Unmarshal(v, &value); err != nil {
+			return false, fmt.Errorf("can't decode %s for the block %d: %w", m.Name(), blockNumber, err)
 		}
 
-		prevBlock = blockNumber
-		bodyRlp, err := rawdb.DecompressBlockBody(v)
-		if err != nil {
+		if _, err := fmt.Fprintf(w, "%d, %d, %d\n", blockNumber, value.TotalGasUsed, value.AverageGasPrice); err != nil {
 			return false, err
 		}
-		body := new(types.Body)
-		if err := rlp.Decode(bytes.NewReader(bodyRlp), body); err != nil {
-			return false, fmt.Errorf("invalid block body RLP: %w", err)
-		}
-		header := rawdb.ReadHeader(db, blockHash, blockNumber)
-		senders := rawdb.ReadSenders(db, blockHash, blockNumber)
-		var ethSpent uint256.Int
-		var ethSpentTotal uint256.Int
-		var totalGas uint256.Int
-
-		count := 0
-
-		for i, tx := range body.Transactions {
-			ethSpent.SetUint64(tx.Gas())
-			totalGas.Add(&totalGas, &ethSpent)
-			if senders[i] == header.Coinbase {
-				continue // Mining pool sending payout potentially with abnormally low fee, skip
-			}
-			ethSpent.Mul(&ethSpent, tx.GasPrice())
-			ethSpentTotal.Add(&ethSpentTotal, &ethSpent)
-			count++
-		}
-		if count > 0 {
-			ethSpentTotal.Div(&ethSpentTotal, &totalGas)
-			ethSpentTotal.Div(&ethSpentTotal, &gwei)
-			gasPrice := ethSpentTotal.Uint64()
-			burntGas += header.GasUsed
-			if _, err := fmt.Fprintf(w, "%d, %d, %d\n", blockNumber, burntGas, gasPrice); err != nil {
-				return false, err
-			}
-		}
 		return true, nil
 	})
+	if err != nil {
+		return err
+	}
 
-	log.Info("walking through block bodies... DONE")
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	log.Info("Exporting " + m.Name() + "... DONE")
+	return nil
+}
+
+// openDatabase opens the node DB read-only, the node should be stopped.
+func openDatabase(ctx *cli.Context) (*ethdb.ObjectDatabase, error) {
+	// the same as `node.Params.CustomBuckets` does when running the node
+	buckets := dbutils.DefaultBuckets()
+	for name, cfg := range metric.Buckets(metrics) {
+		buckets[name] = cfg
+	}
+	dbutils.UpdateBucketsList(buckets)
 
-	return err
+	chaindata := filepath.Join(ctx.String(utils.DataDirFlag.Name), "tg", "chaindata")
+	return ethdb.Open(chaindata, true)
 }
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/mandrigin/turbo-api-examples/supply"
 
+	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/rpc"
@@ -13,6 +15,10 @@ import (
 	"github.com/holiman/uint256"
 )
 
+// maxSupplyRangeResults is the maximum number of entries `tg_getSupplyRange` returns in one response.
+// If the range contains more entries, the response contains `next_block` to continue from.
+const maxSupplyRangeResults = 10_000
+
 var _ SupplyAPI = &API{}
 
 // API - implementation of ExampleApi
@@ -24,6 +30,60 @@ type API struct {
 type GetSupplyResponse struct {
 	BlockNumber uint64 `json:"block_number"`
 	Supply      string `json:"supply"`
+	// LockedSupply and CirculatingSupply are empty if they aren't calculated for the block yet.
+	LockedSupply      string `json:"locked_supply,omitempty"`
+	CirculatingSupply string `json:"circulating_supply,omitempty"`
+	// ContractSupply and EOASupply are empty if they aren't calculated for the block yet.
+	ContractSupply string `json:"contract_supply,omitempty"`
+	EOASupply      string `json:"eoa_supply,omitempty"`
+}
+
+type GetSupplyRangeResponse struct {
+	Supplies  []*GetSupplyResponse `json:"supplies"`
+	NextBlock *uint64              `json:"next_block,omitempty"`
+}
+
+type GetHolderCountResponse struct {
+	BlockNumber uint64 `json:"block_number"`
+	Holders     uint64 `json:"holders"`
+}
+
+type HistogramBucket struct {
+	Range    string `json:"range"`
+	Accounts uint64 `json:"accounts"`
+}
+
+type GetBalanceHistogramResponse struct {
+	BlockNumber uint64             `json:"block_number"`
+	Buckets     []*HistogramBucket `json:"buckets"`
+}
+
+type RichListAccount struct {
+	Address common.Address `json:"address"`
+	Balance string         `json:"balance"`
+}
+
+type GetRichListResponse struct {
+	BlockNumber uint64             `json:"block_number"`
+	Accounts    []*RichListAccount `json:"accounts"`
+}
+
+type GetConcentrationResponse struct {
+	BlockNumber         uint64  `json:"block_number"`
+	Holders             uint64  `json:"holders"`
+	Gini                float64 `json:"gini"`
+	Top01PercentShare   float64 `json:"top_0_1_percent_share"`
+	Top1PercentShare    float64 `json:"top_1_percent_share"`
+	Top10PercentShare   float64 `json:"top_10_percent_share"`
+	NakamotoCoefficient uint64  `json:"nakamoto_coefficient"`
+}
+
+type GetIssuanceResponse struct {
+	BlockNumber         uint64 `json:"block_number"`
+	BlockReward         string `json:"block_reward"`
+	UncleReward         string `json:"uncle_reward"`
+	UnexplainedDecrease string `json:"unexplained_decrease"`
+	UnexplainedIncrease string `json:"unexplained_increase"`
 }
 
 func NewAPI(kv ethdb.RoKV, db ethdb.Getter) *API {
@@ -31,17 +91,9 @@ func NewAPI(kv ethdb.RoKV, db ethdb.Getter) *API {
 }
 
 func (api *API) GetSupply(ctx context.Context, rpcBlockNumber rpc.BlockNumber) (interface{}, error) {
-	var err error
-	var blockNumber uint64
-	if rpcBlockNumber == rpc.PendingBlockNumber {
-		return nil, fmt.Errorf("supply for pending block not supported")
-	} else if rpcBlockNumber == rpc.LatestBlockNumber {
-		blockNumber, err = stages.GetStageProgress(api.db, supply.StageID)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		blockNumber = uint64(rpcBlockNumber)
+	blockNumber, err := api.blockNumber(rpcBlockNumber)
+	if err != nil {
+		return nil, err
 	}
 
 	var supplyValue *uint256.Int
@@ -50,11 +102,276 @@ func (api *API) GetSupply(ctx context.Context, rpcBlockNumber rpc.BlockNumber) (
 		if err == ethdb.ErrKeyNotFound {
 			return nil, fmt.Errorf("the ETH supply is not calculated yet for the block %d", blockNumber)
 		}
+		return nil, supplyError(err)
+	}
+
+	return api.supplyResponse(blockNumber, supplyValue)
+}
+
+func (api *API) GetSupplyRange(ctx context.Context, rpcFrom, rpcTo rpc.BlockNumber, step *uint64) (interface{}, error) {
+	from, err := api.blockNumber(rpcFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := api.blockNumber(rpcTo)
+	if err != nil {
 		return nil, err
 	}
 
-	return &GetSupplyResponse{
+	if from > to {
+		return nil, fmt.Errorf("invalid range: from (%d) is greater than to (%d)", from, to)
+	}
+
+	var stepValue uint64 = 1
+	if step != nil {
+		stepValue = *step
+	}
+	if stepValue == 0 {
+		return nil, fmt.Errorf("step must be greater than 0")
+	}
+
+	response := &GetSupplyRangeResponse{Supplies: make([]*GetSupplyResponse, 0)}
+
+	err = supply.GetSupplyRange(api.db, from, to, func(blockNumber uint64, supplyValue *uint256.Int) (bool, error) {
+		if (blockNumber-from)%stepValue != 0 {
+			return true, nil
+		}
+
+		if len(response.Supplies) == maxSupplyRangeResults {
+			response.NextBlock = &blockNumber
+			return false, nil
+		}
+
+		supplyResponse, err := api.supplyResponse(blockNumber, supplyValue)
+		if err != nil {
+			return false, err
+		}
+
+		response.Supplies = append(response.Supplies, supplyResponse)
+		return true, nil
+	})
+	if err != nil {
+		return nil, supplyError(err)
+	}
+
+	return response, nil
+}
+
+func (api *API) GetIssuance(ctx context.Context, rpcBlockNumber rpc.BlockNumber) (interface{}, error) {
+	blockNumber, err := api.blockNumber(rpcBlockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockNumber == 0 {
+		return nil, fmt.Errorf("there is no ETH issuance for genesis")
+	}
+
+	var issuance *supply.Issuance
+	issuance, err = supply.GetIssuanceForBlock(api.db, blockNumber)
+	if err != nil {
+		if err == ethdb.ErrKeyNotFound {
+			return nil, fmt.Errorf("the ETH issuance is not calculated yet for the block %d", blockNumber)
+		}
+		return nil, err
+	}
+
+	return &GetIssuanceResponse{
+		BlockNumber:         blockNumber,
+		BlockReward:         issuance.BlockReward.ToBig().String(),
+		UncleReward:         issuance.UncleReward.ToBig().String(),
+		UnexplainedDecrease: issuance.UnexplainedDecrease.ToBig().String(),
+		UnexplainedIncrease: issuance.UnexplainedIncrease.ToBig().String(),
+	}, nil
+}
+
+func (api *API) GetHolderCount(ctx context.Context, rpcBlockNumber rpc.BlockNumber) (interface{}, error) {
+	blockNumber, err := api.blockNumber(rpcBlockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	holders, err := supply.GetHolderCountForBlock(api.db, blockNumber)
+	if err != nil {
+		if err == ethdb.ErrKeyNotFound {
+			return nil, fmt.Errorf("the ETH holder count is not calculated yet for the block %d", blockNumber)
+		}
+		return nil, err
+	}
+
+	return &GetHolderCountResponse{
 		BlockNumber: blockNumber,
-		Supply:      supplyValue.ToBig().String(),
+		Holders:     holders,
+	}, nil
+}
+
+// GetBalanceHistogram returns the histogram of the closest block at or before the requested one that has it stored.
+func (api *API) GetBalanceHistogram(ctx context.Context, rpcBlockNumber rpc.BlockNumber) (interface{}, error) {
+	blockNumber, err := api.blockNumber(rpcBlockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	calculatedUpTo, err := stages.GetStageProgress(api.db, supply.StageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockNumber > calculatedUpTo {
+		return nil, fmt.Errorf("the ETH balance histogram is not calculated yet for the block %d", blockNumber)
+	}
+
+	var storedAt uint64
+	var histogram *supply.Histogram
+	err = api.kv.View(ctx, func(tx ethdb.Tx) error {
+		storedAt, histogram, err = supply.FindHistogram(tx, blockNumber)
+		return err
+	})
+	if err != nil {
+		if err == ethdb.ErrKeyNotFound {
+			return nil, fmt.Errorf("the ETH balance histogram is not calculated yet for the block %d", blockNumber)
+		}
+		return nil, err
+	}
+
+	response := &GetBalanceHistogramResponse{
+		BlockNumber: storedAt,
+		Buckets:     make([]*HistogramBucket, len(histogram)),
+	}
+	for i, accounts := range histogram {
+		response.Buckets[i] = &HistogramBucket{Range: supply.HistogramLabels[i], Accounts: accounts}
+	}
+
+	return response, nil
+}
+
+func (api *API) GetRichList(ctx context.Context, rpcBlockNumber rpc.BlockNumber, n int) (interface{}, error) {
+	blockNumber, err := api.blockNumber(rpcBlockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if n <= 0 {
+		return nil, fmt.Errorf("n must be greater than 0")
+	}
+
+	calculatedUpTo, err := stages.GetStageProgress(api.db, supply.StageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockNumber > calculatedUpTo {
+		return nil, fmt.Errorf("the ETH rich list is not calculated yet for the block %d", blockNumber)
+	}
+
+	var list *supply.RichList
+	err = api.kv.View(ctx, func(tx ethdb.Tx) error {
+		list, err = supply.GetRichList(tx, blockNumber, n)
+		return err
+	})
+	if err != nil {
+		if err == ethdb.ErrKeyNotFound {
+			return nil, fmt.Errorf("the ETH rich list is not calculated yet for the block %d", blockNumber)
+		}
+		return nil, err
+	}
+
+	response := &GetRichListResponse{
+		BlockNumber: blockNumber,
+		Accounts:    make([]*RichListAccount, len(list.Entries)),
+	}
+	for i := range list.Entries {
+		response.Accounts[i] = &RichListAccount{
+			Address: list.Entries[i].Address,
+			Balance: list.Entries[i].Balance.ToBig().String(),
+		}
+	}
+
+	return response, nil
+}
+
+// GetConcentration returns the concentration of the closest block at or before the requested one that has it stored.
+func (api *API) GetConcentration(ctx context.Context, rpcBlockNumber rpc.BlockNumber) (interface{}, error) {
+	blockNumber, err := api.blockNumber(rpcBlockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	calculatedUpTo, err := stages.GetStageProgress(api.db, supply.StageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockNumber > calculatedUpTo {
+		return nil, fmt.Errorf("the ETH concentration is not calculated yet for the block %d", blockNumber)
+	}
+
+	var storedAt uint64
+	var concentration *supply.Concentration
+	err = api.kv.View(ctx, func(tx ethdb.Tx) error {
+		storedAt, concentration, err = supply.FindConcentration(tx, blockNumber)
+		return err
+	})
+	if err != nil {
+		if err == ethdb.ErrKeyNotFound {
+			return nil, fmt.Errorf("the ETH concentration is not calculated yet for the block %d", blockNumber)
+		}
+		return nil, err
+	}
+
+	return &GetConcentrationResponse{
+		BlockNumber:         storedAt,
+		Holders:             concentration.Holders,
+		Gini:                concentration.Gini,
+		Top01PercentShare:   concentration.Top01Share,
+		Top1PercentShare:    concentration.Top1Share,
+		Top10PercentShare:   concentration.Top10Share,
+		NakamotoCoefficient: concentration.Nakamoto,
 	}, nil
 }
+
+// supplyResponse adds the split between contracts and EOAs to the supply of the block.
+func (api *API) supplyResponse(blockNumber uint64, supplyValue *uint256.Int) (*GetSupplyResponse, error) {
+	response := &GetSupplyResponse{
+		BlockNumber: blockNumber,
+		Supply:      supplyValue.ToBig().String(),
+	}
+
+	lockedSupply, err := supply.GetLockedSupplyForBlock(api.db, blockNumber)
+	if err == nil {
+		response.LockedSupply = lockedSupply.ToBig().String()
+		response.CirculatingSupply = uint256.NewInt().Sub(supplyValue, lockedSupply).ToBig().String()
+	} else if err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+
+	contractSupply, err := supply.GetContractSupplyForBlock(api.db, blockNumber)
+	if err == nil {
+		response.ContractSupply = contractSupply.ToBig().String()
+		response.EOASupply = uint256.NewInt().Sub(supplyValue, contractSupply).ToBig().String()
+	} else if err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// supplyError explains the stale supply, the other errors are returned as they are.
+func supplyError(err error) error {
+	if errors.Is(err, supply.ErrStaleSupply) {
+		return fmt.Errorf("the ETH supply was calculated before a chain reorg and is out of date, it will be fixed when the supply stage catches up (%v)", err)
+	}
+	return err
+}
+
+// blockNumber converts the block number from the RPC request to the actual block number,
+// resolving "latest" to the latest block with supply calculated.
+func (api *API) blockNumber(rpcBlockNumber rpc.BlockNumber) (uint64, error) {
+	if rpcBlockNumber == rpc.PendingBlockNumber {
+		return 0, fmt.Errorf("supply for pending block not supported")
+	} else if rpcBlockNumber == rpc.LatestBlockNumber {
+		return stages.GetStageProgress(api.db, supply.StageID)
+	}
+	return uint64(rpcBlockNumber), nil
+}
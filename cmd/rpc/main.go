@@ -4,6 +4,8 @@ import (
 	"context"
 	"os"
 
+	"github.com/mandrigin/turbo-api-examples/metric"
+
 	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/cli"
 	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/commands"
 	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/filters"
@@ -38,6 +40,12 @@ func main() {
 // Create interface for your API
 type SupplyAPI interface {
 	GetSupply(ctx context.Context, blockNumber rpc.BlockNumber) (interface{}, error)
+	GetSupplyRange(ctx context.Context, from, to rpc.BlockNumber, step *uint64) (interface{}, error)
+	GetIssuance(ctx context.Context, blockNumber rpc.BlockNumber) (interface{}, error)
+	GetHolderCount(ctx context.Context, blockNumber rpc.BlockNumber) (interface{}, error)
+	GetBalanceHistogram(ctx context.Context, blockNumber rpc.BlockNumber) (interface{}, error)
+	GetRichList(ctx context.Context, blockNumber rpc.BlockNumber, n int) (interface{}, error)
+	GetConcentration(ctx context.Context, blockNumber rpc.BlockNumber) (interface{}, error)
 }
 
 func APIList(kv ethdb.RoKV, eth core.ApiBackend, cfg *cli.Flags) []rpc.API {
@@ -52,6 +60,7 @@ func APIList(kv ethdb.RoKV, eth core.ApiBackend, cfg *cli.Flags) []rpc.API {
 			Version:   "1.0",
 		},
 	}
+	customAPIList = append(customAPIList, metric.APIs(dbReader, metric.Available)...)
 
 	f := filters.New(eth)
 
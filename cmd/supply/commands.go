@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/mandrigin/turbo-api-examples/supply"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/utils"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	fromFlag = cli.Uint64Flag{
+		Name:  "from",
+		Usage: "The first block of the range",
+	}
+
+	toFlag = cli.Uint64Flag{
+		Name:  "to",
+		Usage: "The last block of the range",
+	}
+
+	// configFlags are the flags of the calculation settings, they should be the same as the node uses
+	configFlags = []cli.Flag{supply.GenesisFlag, supply.WatchlistFlag, supply.HistogramIntervalFlag, supply.SupplyIntervalFlag, supply.SupplyRetentionFlag}
+
+	commands = []cli.Command{
+		{
+			Name:   "verify",
+			Usage:  "Calculate ETH supply both forward and backward and compare the results with each other and with the stored values",
+			Flags:  []cli.Flag{utils.DataDirFlag, supply.GenesisFlag, supply.WatchlistFlag, supply.WorkersFlag, supply.MemoryBudgetFlag, fromFlag, toFlag},
+			Action: verify,
+		},
+		{
+			Name:   "recompute",
+			Usage:  "Calculate ETH supply and issuance for the range again and overwrite the stored values, the other blocks are kept",
+			Flags:  append([]cli.Flag{utils.DataDirFlag, fromFlag, toFlag}, configFlags...),
+			Action: recompute,
+		},
+		{
+			Name:   "reset",
+			Usage:  "Remove all the stored ETH supply values, the node calculates everything from genesis on the next start",
+			Flags:  []cli.Flag{utils.DataDirFlag},
+			Action: reset,
+		},
+		{
+			Name:   "dry-run",
+			Usage:  "Calculate ETH supply for the range and print it together with the stored values without writing anything",
+			Flags:  append([]cli.Flag{utils.DataDirFlag, fromFlag, toFlag}, configFlags...),
+			Action: dryRun,
+		},
+	}
+)
+
+func verify(ctx *cli.Context) error {
+	db, err := openDatabase(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(context.Background(), ethdb.RO)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = supply.CheckFormatVersion(tx); err != nil {
+		return err
+	}
+
+	genesis, err := supply.GenesisFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := supply.BackwardConfigFromContext(ctx, db, "")
+	if err != nil {
+		return err
+	}
+
+	mismatches, err := supply.Verify(tx, genesis, ctx.Uint64(fromFlag.Name), ctx.Uint64(toFlag.Name), cfg, func(m *supply.Mismatch) {
+		fmt.Println("MISMATCH", m)
+	})
+	if err != nil {
+		return err
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("ETH supply verification failed: %d mismatching blocks", mismatches)
+	}
+
+	log.Info("ETH supply verification... OK")
+	return nil
+}
+
+func recompute(ctx *cli.Context) error {
+	db, err := openDatabase(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = supply.CheckFormatVersion(tx); err != nil {
+		return err
+	}
+
+	genesis, err := supply.GenesisFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := supply.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	chainConfig, err := readChainConfig(tx)
+	if err != nil {
+		return err
+	}
+
+	changed, err := supply.Recompute(tx, genesis, chainConfig, ctx.Uint64(fromFlag.Name), ctx.Uint64(toFlag.Name), cfg)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Info("ETH supply recomputation... DONE", "changed", changed)
+	return nil
+}
+
+func reset(ctx *cli.Context) error {
+	db, err := openDatabase(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = supply.Reset(tx); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Info("ETH supply reset... DONE")
+	return nil
+}
+
+func dryRun(ctx *cli.Context) error {
+	db, err := openDatabase(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(context.Background(), ethdb.RO)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = supply.CheckFormatVersion(tx); err != nil {
+		return err
+	}
+
+	genesis, err := supply.GenesisFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := supply.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return supply.DryRun(tx, genesis, ctx.Uint64(fromFlag.Name), ctx.Uint64(toFlag.Name), cfg, func(b *supply.BlockTotals) {
+		fmt.Println(b)
+	})
+}
+
+// readChainConfig reads the config of the chain the datadir belongs to, the issuance depends on it.
+func readChainConfig(db ethdb.Database) (*params.ChainConfig, error) {
+	genesisHash, err := rawdb.ReadCanonicalHash(db, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	chainConfig, err := rawdb.ReadChainConfig(db, genesisHash)
+	if err != nil {
+		return nil, err
+	}
+	if chainConfig == nil {
+		return nil, fmt.Errorf("no chain config for the genesis %x", genesisHash)
+	}
+	return chainConfig, nil
+}
+
+// openDatabase opens the chaindata of an existing datadir without starting the node.
+// It fails if the node is running, because the DB is locked by it.
+func openDatabase(ctx *cli.Context, readOnly bool) (*ethdb.ObjectDatabase, error) {
+	// the same as `node.Params.CustomBuckets` does when running the node
+	buckets := dbutils.DefaultBuckets()
+	for name, cfg := range customBuckets() {
+		buckets[name] = cfg
+	}
+	dbutils.UpdateBucketsList(buckets)
+
+	chaindata := filepath.Join(ctx.String(utils.DataDirFlag.Name), "tg", "chaindata")
+	log.Info("Opening the database", "path", chaindata, "readOnly", readOnly)
+
+	return ethdb.Open(chaindata, readOnly)
+}
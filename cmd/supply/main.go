@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/mandrigin/turbo-api-examples/metric"
 	"github.com/mandrigin/turbo-api-examples/supply"
 
+	"github.com/ledgerwatch/turbo-geth/cmd/utils"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
 	"github.com/ledgerwatch/turbo-geth/log"
@@ -17,7 +19,9 @@ import (
 )
 
 func main() {
-	app := turbocli.MakeApp(runTurboGeth, turbocli.DefaultFlags)
+	flags := append(append(turbocli.DefaultFlags, supply.Flags...), metric.Flags...)
+	app := turbocli.MakeApp(runTurboGeth, flags)
+	app.Commands = commands
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -25,22 +29,56 @@ func main() {
 }
 
 func runTurboGeth(ctx *cli.Context) {
+	if err := migrateDatabase(ctx); err != nil {
+		utils.Fatalf("Can't start the ETH supply node: %v", err)
+	}
+
+	metrics, err := metric.EnabledFromContext(ctx)
+	if err != nil {
+		utils.Fatalf("Can't start the ETH supply node: %v", err)
+	}
+
+	stages, unwindOrder := supply.NodeStages(ctx, metric.SyncStages(metrics)...)
+
 	sync := stagedsync.New(
-		append(stagedsync.DefaultStages(), supply.SyncStage(ctx)),
-		stagedsync.DefaultUnwindOrder(),
+		stages,
+		unwindOrder,
 		stagedsync.OptionalParameters{},
 	)
 
-	// Adding a custom bucket where we will store eth supply per block
+	// Adding custom buckets where we will store eth supply and issuance per block
 	params := node.Params{
-		CustomBuckets: map[string]dbutils.BucketConfigItem{supply.BucketName: {}},
+		CustomBuckets: customBuckets(),
 	}
 
 	tg := node.New(ctx, sync, params)
 
-	err := tg.Serve()
+	err = tg.Serve()
 
 	if err != nil {
 		log.Error("error while serving a turbo-geth node", "err", err)
 	}
 }
+
+// customBuckets are the buckets of the supply and of all the metrics (even if they aren't enabled).
+func customBuckets() dbutils.BucketsCfg {
+	buckets := make(dbutils.BucketsCfg)
+	for name, cfg := range supply.Buckets {
+		buckets[name] = cfg
+	}
+	for name, cfg := range metric.Buckets(metric.Available) {
+		buckets[name] = cfg
+	}
+	return buckets
+}
+
+// migrateDatabase converts the supply data to the current format before the node opens the DB.
+func migrateDatabase(ctx *cli.Context) error {
+	db, err := openDatabase(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return supply.Migrate(db)
+}
@@ -0,0 +1,76 @@
+package metric
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// API serves the values of the metrics as `tg_getMetric`.
+// The RPC method names are derived from the Go methods, so there is one method for all the metrics.
+type API struct {
+	db      ethdb.Getter
+	metrics map[string]BlockMetric
+}
+
+type GetMetricResponse struct {
+	BlockNumber uint64          `json:"block_number"`
+	Value       json.RawMessage `json:"value"`
+}
+
+func NewAPI(db ethdb.Getter, metrics []BlockMetric) *API {
+	api := &API{db: db, metrics: make(map[string]BlockMetric, len(metrics))}
+	for _, m := range metrics {
+		api.metrics[m.Name()] = m
+	}
+	return api
+}
+
+// APIs returns the RPC services of the metrics, they should be added to the RPC daemon.
+func APIs(db ethdb.Getter, metrics []BlockMetric) []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: "tg",
+			Public:    true,
+			Service:   NewAPI(db, metrics),
+			Version:   "1.0",
+		},
+	}
+}
+
+func (api *API) GetMetric(ctx context.Context, name string, rpcBlockNumber rpc.BlockNumber) (interface{}, error) {
+	m, ok := api.metrics[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", name)
+	}
+
+	var blockNumber uint64
+	switch rpcBlockNumber {
+	case rpc.PendingBlockNumber:
+		return nil, fmt.Errorf("%s for pending block not supported", name)
+	case rpc.LatestBlockNumber:
+		var err error
+		if blockNumber, err = stages.GetStageProgress(api.db, StageID(m)); err != nil {
+			return nil, err
+		}
+	default:
+		blockNumber = uint64(rpcBlockNumber)
+	}
+
+	value, err := Get(api.db, m, blockNumber)
+	if err != nil {
+		if err == ethdb.ErrKeyNotFound {
+			return nil, fmt.Errorf("%s is not calculated yet for the block %d", name, blockNumber)
+		}
+		return nil, err
+	}
+
+	return &GetMetricResponse{
+		BlockNumber: blockNumber,
+		Value:       value,
+	}, nil
+}
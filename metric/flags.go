@@ -0,0 +1,58 @@
+package metric
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	// MetricsFlag isn't called `--metrics`, that is the turbo-geth flag that enables the node metrics.
+	MetricsFlag = cli.StringFlag{
+		Name:  "custom.metrics",
+		Usage: "Comma-separated names of the additional per-block metrics to calculate: " + strings.Join(names(Available), ", "),
+	}
+
+	// Flags contains all the command-line flags of the metrics.
+	Flags = []cli.Flag{
+		MetricsFlag,
+	}
+)
+
+// EnabledFromContext returns the metrics enabled with the command-line flags.
+func EnabledFromContext(ctx *cli.Context) ([]BlockMetric, error) {
+	var enabled []BlockMetric
+
+	for _, name := range strings.Split(ctx.String(MetricsFlag.Name), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		m := find(Available, name)
+		if m == nil {
+			return nil, fmt.Errorf("unknown metric %q, available: %s", name, strings.Join(names(Available), ", "))
+		}
+		enabled = append(enabled, m)
+	}
+
+	return enabled, nil
+}
+
+func find(metrics []BlockMetric, name string) BlockMetric {
+	for _, m := range metrics {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func names(metrics []BlockMetric) []string {
+	result := make([]string, len(metrics))
+	for i, m := range metrics {
+		result[i] = m.Name()
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package metric
+
+import (
+	"github.com/holiman/uint256"
+)
+
+var gwei = uint256.NewInt().SetUint64(1e9)
+
+// AverageGasPrice is the average gas price of the transactions in the block and the total gas used up to it.
+// The transactions sent by the miner of the block are skipped: mining pools pay out with abnormally low fees.
+// It needs the receipts of the transactions (see Block.Receipts).
+type AverageGasPrice struct{}
+
+type GasPrice struct {
+	// AverageGasPrice is in gwei, weighted by the gas used by the transactions (0 if there are none)
+	AverageGasPrice uint64 `json:"average_gas_price"`
+	TotalGasUsed    uint64 `json:"total_gas_used"`
+}
+
+func (AverageGasPrice) Name() string {
+	return "AVERAGE_GAS_PRICE"
+}
+
+func (AverageGasPrice) Zero() interface{} {
+	return &GasPrice{}
+}
+
+func (AverageGasPrice) Calculate(block *Block, previous interface{}) (interface{}, error) {
+	value := &GasPrice{
+		TotalGasUsed: previous.(*GasPrice).TotalGasUsed + block.Header.GasUsed,
+	}
+
+	receipts, err := block.Receipts()
+	if err != nil {
+		return nil, err
+	}
+
+	var gas, spent, fee uint256.Int
+
+	for i, tx := range block.Transactions {
+		if i < len(block.Senders) && block.Senders[i] == block.Header.Coinbase {
+			continue
+		}
+
+		fee.SetUint64(receipts[i].GasUsed)
+		gas.Add(&gas, &fee)
+
+		fee.Mul(&fee, tx.GasPrice())
+		spent.Add(&spent, &fee)
+	}
+
+	if !gas.IsZero() {
+		spent.Div(&spent, &gas)
+		value.AverageGasPrice = spent.Div(&spent, gwei).Uint64()
+	}
+
+	return value, nil
+}
@@ -0,0 +1,82 @@
+// Package metric calculates custom per-block metrics in a turbo-geth stage.
+//
+// A metric only says how to calculate its value for a block (see BlockMetric),
+// the package takes care of the rest: the sync stage, the storage, the unwinds and the RPC.
+package metric
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Available are the metrics that can be enabled with the `--custom.metrics` flag, new metrics are added here.
+var Available = []BlockMetric{
+	AverageGasPrice{},
+}
+
+// BlockMetric is a value that is calculated for every block from the block and the accounts that changed in it.
+type BlockMetric interface {
+	// Name is the unique name of the metric, like AVG_GAS_PRICE.
+	// The stage, the bucket and the RPC requests refer to the metric by it.
+	Name() string
+	// Zero returns a pointer to the zero value of the metric. The stored values are decoded into it.
+	Zero() interface{}
+	// Calculate returns the value of the metric at the block from its value at the previous block
+	// (the Zero value for genesis), so the cumulative metrics are easy too. The value must be
+	// of the same type as Zero returns and `previous` mustn't be modified.
+	// The value is stored as JSON and `tg_getMetric` returns it as it is.
+	Calculate(block *Block, previous interface{}) (interface{}, error)
+}
+
+// Block is the data of a block that the metrics are calculated from.
+type Block struct {
+	Header       *types.Header
+	Transactions types.Transactions
+	Uncles       []*types.Header
+	// Senders are the senders of the transactions, in the same order
+	Senders []common.Address
+
+	// the account changes and the receipts are read only if the metric needs them
+	number   uint64
+	hash     common.Hash
+	db       ethdb.Getter
+	tx       ethdb.Tx
+	accounts []AccountChange
+	receipts types.Receipts
+}
+
+// Number returns the number of the block.
+func (b *Block) Number() uint64 {
+	return b.number
+}
+
+// AccountChange is the state of an account before and after the block.
+type AccountChange struct {
+	Address common.Address
+	// Before and After are nil if the account doesn't exist
+	Before *accounts.Account
+	After  *accounts.Account
+}
+
+// BucketName is the bucket with the values of the metric.
+func BucketName(m BlockMetric) string {
+	return "org.ffconsulting.tg.db." + m.Name()
+}
+
+// StageID is the ID of the stage that calculates the metric.
+func StageID(m BlockMetric) stages.SyncStage {
+	return stages.SyncStage("org.ffconsulting." + m.Name())
+}
+
+// Buckets are the buckets of the metrics, they should be added to `node.Params.CustomBuckets`.
+func Buckets(metrics []BlockMetric) dbutils.BucketsCfg {
+	buckets := make(dbutils.BucketsCfg, len(metrics))
+	for _, m := range metrics {
+		buckets[BucketName(m)] = dbutils.BucketConfigItem{}
+	}
+	return buckets
+}
@@ -0,0 +1,328 @@
+package metric
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+var coinbase = common.HexToAddress("0xc0")
+
+// changedAccounts is the test metric: the number of the changed accounts up to the block
+// and the total balance of the accounts changed in the block.
+type changedAccounts struct{}
+
+type changedAccountsValue struct {
+	Accounts uint64 `json:"accounts"`
+	Balance  uint64 `json:"balance"`
+}
+
+func (changedAccounts) Name() string      { return "TEST_CHANGED_ACCOUNTS" }
+func (changedAccounts) Zero() interface{} { return &changedAccountsValue{} }
+
+func (changedAccounts) Calculate(block *Block, previous interface{}) (interface{}, error) {
+	changes, err := block.Accounts()
+	if err != nil {
+		return nil, err
+	}
+
+	value := &changedAccountsValue{Accounts: previous.(*changedAccountsValue).Accounts + uint64(len(changes))}
+	for _, change := range changes {
+		if change.After != nil {
+			value.Balance += change.After.Balance.Uint64()
+		}
+	}
+	return value, nil
+}
+
+// newTestDB creates an in-memory DB with the buckets of the metrics.
+func newTestDB(tb testing.TB, metrics []BlockMetric) *ethdb.ObjectDatabase {
+	kv := ethdb.NewLMDB().InMem().WithBucketsConfig(func(dbutils.BucketsCfg) dbutils.BucketsCfg {
+		buckets := dbutils.DefaultBuckets()
+		for name, cfg := range Buckets(metrics) {
+			buckets[name] = cfg
+		}
+		return buckets
+	}).MustOpen()
+
+	db := ethdb.NewObjectDatabase(kv)
+	tb.Cleanup(db.Close)
+	return db
+}
+
+// newTestChain creates a DB with `blocks` blocks after genesis. Every block has 3 transactions
+// (the first one is sent by the miner) with their receipts and changes a few random accounts.
+// It returns the expected values of changedAccounts.
+func newTestChain(tb testing.TB, db ethdb.Database, blocks int) []changedAccountsValue {
+	rnd := rand.New(rand.NewSource(1))
+	expected := make([]changedAccountsValue, blocks+1)
+
+	accountsState := make(map[common.Address]*accounts.Account)
+
+	for blockNumber := 0; blockNumber <= blocks; blockNumber++ {
+		header := &types.Header{
+			Number:   big.NewInt(int64(blockNumber)),
+			Coinbase: coinbase,
+			GasUsed:  uint64(blockNumber) * 1000,
+		}
+
+		var txs []*types.Transaction
+		var senders []common.Address
+		if blockNumber > 0 {
+			txs = []*types.Transaction{
+				types.NewTransaction(0, common.Address{}, uint256.NewInt(), 21_000, uint256.NewInt().Mul(gwei, uint256.NewInt().SetUint64(1)), nil),
+				types.NewTransaction(0, common.Address{}, uint256.NewInt(), 21_000, uint256.NewInt().Mul(gwei, uint256.NewInt().SetUint64(10)), nil),
+				types.NewTransaction(1, common.Address{}, uint256.NewInt(), 42_000, uint256.NewInt().Mul(gwei, uint256.NewInt().SetUint64(40)), nil),
+			}
+			senders = []common.Address{coinbase, common.HexToAddress("0x01"), common.HexToAddress("0x01")}
+		}
+
+		hash := header.Hash()
+		rawdb.WriteHeader(context.Background(), db, header)
+		if err := rawdb.WriteCanonicalHash(db, hash, uint64(blockNumber)); err != nil {
+			tb.Fatal(err)
+		}
+		if err := rawdb.WriteBody(db, hash, uint64(blockNumber), &types.Body{Transactions: txs}); err != nil {
+			tb.Fatal(err)
+		}
+		if err := rawdb.WriteSenders(context.Background(), db, hash, uint64(blockNumber), senders); err != nil {
+			tb.Fatal(err)
+		}
+		// the last transaction uses a half of its gas limit
+		if blockNumber > 0 {
+			receipts := types.Receipts{{CumulativeGasUsed: 21_000}, {CumulativeGasUsed: 42_000}, {CumulativeGasUsed: 63_000}}
+			if err := rawdb.WriteReceipts(db, uint64(blockNumber), receipts); err != nil {
+				tb.Fatal(err)
+			}
+		}
+
+		if blockNumber == 0 {
+			continue
+		}
+
+		w := state.NewPlainStateWriter(db, db, uint64(blockNumber))
+		expected[blockNumber].Accounts = expected[blockNumber-1].Accounts
+
+		changed := make(map[common.Address]struct{})
+		for len(changed) < 5 {
+			var address common.Address
+			binary.BigEndian.PutUint64(address[12:], uint64(rnd.Intn(20)))
+			changed[address] = struct{}{}
+		}
+
+		for address := range changed {
+			original := accounts.NewAccount()
+			if acc, ok := accountsState[address]; ok {
+				original = *acc
+			}
+
+			updated := original
+			updated.Initialised = true
+			updated.Nonce++
+			updated.Balance.SetUint64(uint64(rnd.Intn(1000)))
+
+			if err := w.UpdateAccountData(context.Background(), address, &original, &updated); err != nil {
+				tb.Fatal(err)
+			}
+
+			accountsState[address] = &updated
+			expected[blockNumber].Accounts++
+			expected[blockNumber].Balance += updated.Balance.Uint64()
+		}
+
+		if err := w.WriteChangeSets(); err != nil {
+			tb.Fatal(err)
+		}
+		if err := w.WriteHistory(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return expected
+}
+
+func TestCalculate(t *testing.T) {
+	m := changedAccounts{}
+	db := newTestDB(t, []BlockMetric{m})
+	expected := newTestChain(t, db, 50)
+
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err = Calculate(tx, m, 0, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Unwind(tx, m, 20); err != nil {
+		t.Fatal(err)
+	}
+	for blockNumber := uint64(21); blockNumber <= 30; blockNumber++ {
+		if _, err = Get(tx, m, blockNumber); err != ethdb.ErrKeyNotFound {
+			t.Fatalf("expected the block %d to be unwound, got %v", blockNumber, err)
+		}
+	}
+	if _, err = Get(tx, m, 20); err != nil {
+		t.Fatalf("expected the block 20 to be kept, got %v", err)
+	}
+
+	// continues from the value at the unwind point
+	if err = Calculate(tx, m, 21, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	for blockNumber := range expected {
+		var value changedAccountsValue
+		if err = get(tx, m, uint64(blockNumber), &value); err != nil {
+			t.Fatal(err)
+		}
+		if value != expected[blockNumber] {
+			t.Errorf("block %d: %+v, expected %+v", blockNumber, value, expected[blockNumber])
+		}
+	}
+}
+
+// TestSyncStage runs the stage outside of a transaction, like the initial sync does when the node is far behind.
+func TestSyncStage(t *testing.T) {
+	m := changedAccounts{}
+	db := newTestDB(t, []BlockMetric{m})
+	expected := newTestChain(t, db, 20)
+
+	if err := stages.SaveStageProgress(db, stages.Execution, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	stage := SyncStage(m).Build(stagedsync.StageParameters{DB: db, TX: db})
+
+	if err := stage.ExecFunc(&stagedsync.StageState{Stage: StageID(m)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// committed by the stage
+	if progress, err := stages.GetStageProgress(db, StageID(m)); err != nil || progress != 20 {
+		t.Fatalf("expected the stage progress 20, got %d (%v)", progress, err)
+	}
+	for blockNumber := range expected {
+		var value changedAccountsValue
+		if err := get(db, m, uint64(blockNumber), &value); err != nil {
+			t.Fatal(err)
+		}
+		if value != expected[blockNumber] {
+			t.Errorf("block %d: %+v, expected %+v", blockNumber, value, expected[blockNumber])
+		}
+	}
+
+	err := stage.UnwindFunc(&stagedsync.UnwindState{Stage: StageID(m), UnwindPoint: 10}, &stagedsync.StageState{Stage: StageID(m), BlockNumber: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if progress, err := stages.GetStageProgress(db, StageID(m)); err != nil || progress != 10 {
+		t.Fatalf("expected the stage progress 10 after the unwind, got %d (%v)", progress, err)
+	}
+	if _, err = Get(db, m, 11); err != ethdb.ErrKeyNotFound {
+		t.Errorf("expected the block 11 to be unwound, got %v", err)
+	}
+	if _, err = Get(db, m, 10); err != nil {
+		t.Errorf("expected the block 10 to be kept, got %v", err)
+	}
+}
+
+func TestAverageGasPrice(t *testing.T) {
+	m := AverageGasPrice{}
+	db := newTestDB(t, []BlockMetric{m})
+	newTestChain(t, db, 10)
+
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err = Calculate(tx, m, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	for blockNumber, expected := range map[uint64]GasPrice{
+		0: {AverageGasPrice: 0, TotalGasUsed: 0},
+		1: {AverageGasPrice: 25, TotalGasUsed: 1000},
+		// the miner's transaction is skipped and the prices are weighted by the gas used: (21000 * 10 + 21000 * 40) / (21000 + 21000)
+		10: {AverageGasPrice: 25, TotalGasUsed: 55_000},
+	} {
+		var value GasPrice
+		if err = get(tx, m, blockNumber, &value); err != nil {
+			t.Fatal(err)
+		}
+		if value != expected {
+			t.Errorf("block %d: %+v, expected %+v", blockNumber, value, expected)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	m := changedAccounts{}
+	db := newTestDB(t, []BlockMetric{m})
+	expected := newTestChain(t, db, 10)
+
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err = Calculate(tx, m, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err = stages.SaveStageProgress(tx, StageID(m), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewAPI(tx, []BlockMetric{m})
+
+	for _, tc := range []struct {
+		rpcBlockNumber rpc.BlockNumber
+		blockNumber    uint64
+	}{
+		{5, 5},
+		{rpc.LatestBlockNumber, 10},
+	} {
+		response, err := api.GetMetric(context.Background(), m.Name(), tc.rpcBlockNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metricResponse := response.(*GetMetricResponse)
+
+		var value changedAccountsValue
+		if err = json.Unmarshal(metricResponse.Value, &value); err != nil {
+			t.Fatal(err)
+		}
+		if metricResponse.BlockNumber != tc.blockNumber || value != expected[tc.blockNumber] {
+			t.Errorf("block %d: %d %+v, expected %+v", tc.rpcBlockNumber, metricResponse.BlockNumber, value, expected[tc.blockNumber])
+		}
+	}
+
+	if _, err = api.GetMetric(context.Background(), m.Name(), 11); err == nil {
+		t.Error("expected an error for the block that isn't calculated yet")
+	}
+	if _, err = api.GetMetric(context.Background(), "UNKNOWN", 1); err == nil {
+		t.Error("expected an error for an unknown metric")
+	}
+}
@@ -0,0 +1,306 @@
+package metric
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// SyncStages returns the stages that calculate the metrics, one stage per metric.
+func SyncStages(metrics []BlockMetric) stagedsync.StageBuilders {
+	builders := make(stagedsync.StageBuilders, len(metrics))
+	for i, m := range metrics {
+		builders[i] = SyncStage(m)
+	}
+	return builders
+}
+
+// SyncStage returns the stage that calculates the metric for every executed block.
+func SyncStage(m BlockMetric) stagedsync.StageBuilder {
+	id := StageID(m)
+
+	return stagedsync.StageBuilder{
+		ID: id,
+		Build: func(world stagedsync.StageParameters) *stagedsync.Stage {
+			return &stagedsync.Stage{
+				ID:          id,
+				Description: "Calculate " + m.Name(),
+				ExecFunc: func(s *stagedsync.StageState, _ stagedsync.Unwinder) error {
+					tx, ownTx, err := beginStageTx(world.TX)
+					if err != nil {
+						return err
+					}
+					if ownTx {
+						defer tx.Rollback()
+					}
+
+					executionAt, err := s.ExecutionAt(tx)
+					if err != nil {
+						return err
+					}
+
+					// the stage progress is the last calculated block, so 0 means that nothing is calculated yet
+					from := s.BlockNumber + 1
+					if s.BlockNumber == 0 {
+						from = 0
+					}
+
+					if from > executionAt {
+						s.Done()
+						return nil
+					}
+
+					log.Info("Calculating "+m.Name(), "from", from, "to", executionAt)
+					if err = Calculate(tx, m, from, executionAt); err != nil {
+						return err
+					}
+
+					if err = s.DoneAndUpdate(tx, executionAt); err != nil {
+						return err
+					}
+
+					if ownTx {
+						return tx.Commit()
+					}
+					return nil
+				},
+
+				UnwindFunc: func(u *stagedsync.UnwindState, s *stagedsync.StageState) error {
+					tx, ownTx, err := beginStageTx(world.TX)
+					if err != nil {
+						return err
+					}
+					if ownTx {
+						defer tx.Rollback()
+					}
+
+					if err = Unwind(tx, m, u.UnwindPoint); err != nil {
+						return err
+					}
+
+					if err = u.Done(tx); err != nil {
+						return err
+					}
+
+					if ownTx {
+						return tx.Commit()
+					}
+					return nil
+				},
+			}
+		},
+	}
+}
+
+// beginStageTx returns the transaction of the staged sync if it runs in one.
+// Otherwise (the initial sync of a node that is far behind), it begins a new transaction
+// that the stage has to commit itself (`ownTx` is true).
+func beginStageTx(db ethdb.Database) (tx ethdb.DbWithPendingMutations, ownTx bool, err error) {
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		return db.(ethdb.DbWithPendingMutations), false, nil
+	}
+
+	tx, err = db.Begin(context.Background(), ethdb.RW)
+	return tx, true, err
+}
+
+// Calculate calculates the metric for the blocks from `from` to `to` (inclusive) and stores it.
+// The metric must be already stored for the block `from-1`.
+func Calculate(db ethdb.Database, m BlockMetric, from, to uint64) error {
+	hasTx, ok := db.(ethdb.HasTx)
+	if !ok || hasTx.Tx() == nil {
+		return fmt.Errorf("should be a transaction, got %T", db)
+	}
+
+	previous := m.Zero()
+	if from > 0 {
+		if err := get(db, m, from-1, previous); err != nil {
+			return fmt.Errorf("no %s for the block %d to continue from: %w", m.Name(), from-1, err)
+		}
+	}
+
+	for blockNumber := from; blockNumber <= to; blockNumber++ {
+		block, err := readBlock(db, hasTx.Tx(), blockNumber)
+		if err != nil {
+			return err
+		}
+
+		value, err := m.Calculate(block, previous)
+		if err != nil {
+			return fmt.Errorf("can't calculate %s for the block %d: %w", m.Name(), blockNumber, err)
+		}
+
+		enc, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		if err = db.Put(BucketName(m), dbutils.EncodeBlockNumber(blockNumber), enc); err != nil {
+			return err
+		}
+
+		if blockNumber%10_000 == 0 {
+			log.Info("Calculating "+m.Name(), "block", blockNumber, "value", string(enc))
+		}
+
+		previous = value
+	}
+
+	return nil
+}
+
+// readBlock reads the block, the account changes are read on demand.
+func readBlock(db ethdb.Database, tx ethdb.Tx, blockNumber uint64) (*Block, error) {
+	hash, err := rawdb.ReadCanonicalHash(db, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	header := rawdb.ReadHeader(db, hash, blockNumber)
+	if header == nil {
+		return nil, fmt.Errorf("no header for the block %d", blockNumber)
+	}
+
+	body := rawdb.ReadBody(db, hash, blockNumber)
+	if body == nil {
+		return nil, fmt.Errorf("no body for the block %d", blockNumber)
+	}
+
+	senders, err := rawdb.ReadSenders(db, hash, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Block{
+		Header:       header,
+		Transactions: body.Transactions,
+		Uncles:       body.Uncles,
+		Senders:      senders,
+		number:       blockNumber,
+		hash:         hash,
+		db:           db,
+		tx:           tx,
+	}, nil
+}
+
+// Accounts returns the accounts that changed in the block (none for genesis).
+// They are read from the history, so it is way slower than the rest of the block.
+func (b *Block) Accounts() ([]AccountChange, error) {
+	if b.accounts != nil {
+		return b.accounts, nil
+	}
+
+	b.accounts = make([]AccountChange, 0)
+
+	// the changeset contains the accounts before the block, the history has them after it
+	err := changeset.Walk(b.db, dbutils.PlainAccountChangeSetBucket, dbutils.EncodeBlockNumber(b.number), 8*8, func(_ uint64, k, accountDataBeforeBlock []byte) (bool, error) {
+		before, err := decodeAccount(accountDataBeforeBlock)
+		if err != nil {
+			return false, err
+		}
+
+		accountDataAfterBlock, err := state.GetAsOf(b.tx, false, k, b.number+1)
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return false, err
+		}
+
+		after, err := decodeAccount(accountDataAfterBlock)
+		if err != nil {
+			return false, err
+		}
+
+		b.accounts = append(b.accounts, AccountChange{Address: common.BytesToAddress(k), Before: before, After: after})
+		return true, nil
+	})
+	if err != nil {
+		b.accounts = nil
+		return nil, err
+	}
+
+	return b.accounts, nil
+}
+
+// Receipts returns the receipts of the transactions, in the same order.
+// They are stored only if the node keeps the receipts (`r` in `--storage-mode`, it is there by default).
+func (b *Block) Receipts() (types.Receipts, error) {
+	if b.receipts != nil || len(b.Transactions) == 0 {
+		return b.receipts, nil
+	}
+
+	receipts := rawdb.ReadRawReceipts(b.db, b.hash, b.number)
+	if len(receipts) != len(b.Transactions) {
+		return nil, fmt.Errorf("no receipts for the block %d, the node has to store them (`r` in --storage-mode)", b.number)
+	}
+
+	// only the cumulative gas used is stored
+	var previous uint64
+	for _, receipt := range receipts {
+		receipt.GasUsed = receipt.CumulativeGasUsed - previous
+		previous = receipt.CumulativeGasUsed
+	}
+
+	b.receipts = receipts
+	return b.receipts, nil
+}
+
+func decodeAccount(enc []byte) (*accounts.Account, error) {
+	if len(enc) == 0 {
+		return nil, nil
+	}
+
+	account := &accounts.Account{}
+	if err := account.DecodeForStorage(enc); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Get returns the stored value of the metric at the block (JSON).
+// It returns ethdb.ErrKeyNotFound if it isn't calculated for the block.
+func Get(db ethdb.Getter, m BlockMetric, blockNumber uint64) ([]byte, error) {
+	return db.Get(BucketName(m), dbutils.EncodeBlockNumber(blockNumber))
+}
+
+// get decodes the stored value of the metric at the block into `value`.
+func get(db ethdb.Getter, m BlockMetric, blockNumber uint64, value interface{}) error {
+	enc, err := Get(db, m, blockNumber)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(enc, value)
+}
+
+// Unwind removes the values of the metric after the block `to`.
+func Unwind(db ethdb.Database, m BlockMetric, to uint64) error {
+	hasTx, ok := db.(ethdb.HasTx)
+	if !ok || hasTx.Tx() == nil {
+		return fmt.Errorf("should be a transaction, got %T", db)
+	}
+
+	log.Info("Removing "+m.Name(), "after", to)
+
+	c := hasTx.Tx().(ethdb.RwTx).RwCursor(BucketName(m))
+	defer c.Close()
+
+	for k, _, err := c.Seek(dbutils.EncodeBlockNumber(to + 1)); k != nil; k, _, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if err = c.DeleteCurrent(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
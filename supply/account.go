@@ -0,0 +1,110 @@
+package supply
+
+import (
+	"fmt"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+var emptyCodeHash = crypto.Keccak256Hash(nil)
+
+// account contains the fields of the turbo-geth account that are in its storage encoding
+// (see accounts.Account#EncodeForStorage), the storage root isn't there.
+type account struct {
+	nonce       uint64
+	balance     uint256.Int
+	incarnation uint64
+	// codeHash is emptyCodeHash for the accounts without code
+	codeHash common.Hash
+}
+
+// hasCode returns true if the account is a contract.
+func (a *account) hasCode() bool {
+	return a.codeHash != emptyCodeHash
+}
+
+// decodeAccount decodes the storage encoding of the account into `a`, empty `enc` is an empty account.
+// It is the same as accounts.Account#DecodeForStorage, but it doesn't allocate
+// and it returns an error instead of panicking on the truncated data.
+//
+// The encoding is (field set | (length | value)...), the value is big-endian and the field set
+// says which fields are there: 1 is the nonce, 2 is the balance, 4 is the incarnation and 8 is the code hash.
+func decodeAccount(enc []byte, a *account) error {
+	a.nonce = 0
+	a.balance.Clear()
+	a.incarnation = 0
+	a.codeHash = emptyCodeHash
+
+	if len(enc) == 0 {
+		return nil
+	}
+
+	fieldSet := enc[0]
+	pos := 1
+
+	var value []byte
+	var err error
+
+	if fieldSet&1 > 0 {
+		if value, pos, err = accountField(enc, pos, "nonce", 8); err != nil {
+			return err
+		}
+		a.nonce = bytesToUint64(value)
+	}
+
+	if fieldSet&2 > 0 {
+		if value, pos, err = accountField(enc, pos, "balance", 32); err != nil {
+			return err
+		}
+		a.balance.SetBytes(value)
+	}
+
+	if fieldSet&4 > 0 {
+		if value, pos, err = accountField(enc, pos, "incarnation", 8); err != nil {
+			return err
+		}
+		a.incarnation = bytesToUint64(value)
+	}
+
+	// only the code hash of the accounts with code is stored
+	if fieldSet&8 > 0 {
+		if value, _, err = accountField(enc, pos, "code hash", common.HashLength); err != nil {
+			return err
+		}
+		if len(value) != common.HashLength {
+			return fmt.Errorf("malformed account: the code hash is %d bytes long", len(value))
+		}
+		copy(a.codeHash[:], value)
+	}
+
+	return nil
+}
+
+// accountField returns the value of the field that starts at `pos` and the position after it.
+func accountField(enc []byte, pos int, name string, maxLength int) ([]byte, int, error) {
+	if pos >= len(enc) {
+		return nil, 0, fmt.Errorf("malformed account: no %s in %x", name, enc)
+	}
+
+	length := int(enc[pos])
+	if length > maxLength {
+		return nil, 0, fmt.Errorf("malformed account: the %s is %d bytes long, at most %d expected", name, length, maxLength)
+	}
+
+	end := pos + 1 + length
+	if end > len(enc) {
+		return nil, 0, fmt.Errorf("malformed account: the %s is %d bytes long, only %d left in %x", name, length, len(enc)-pos-1, enc)
+	}
+
+	return enc[pos+1 : end], end, nil
+}
+
+func bytesToUint64(value []byte) uint64 {
+	var x uint64
+	for _, b := range value {
+		x = x<<8 | uint64(b)
+	}
+	return x
+}
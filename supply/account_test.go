@@ -0,0 +1,141 @@
+package supply
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// randomAccount generates the accounts with all the combinations of the fields that are in the storage encoding.
+func randomAccount(r *rand.Rand) accounts.Account {
+	acc := accounts.NewAccount()
+	if r.Intn(2) == 0 {
+		acc.Nonce = r.Uint64() >> r.Intn(64)
+	}
+	if r.Intn(2) == 0 {
+		acc.Balance.SetBytes(randomBytes(r, r.Intn(33)))
+	}
+	if r.Intn(2) == 0 {
+		acc.Incarnation = r.Uint64() >> r.Intn(64)
+	}
+	if r.Intn(2) == 0 {
+		copy(acc.CodeHash[:], randomBytes(r, common.HashLength))
+	}
+	return acc
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// decodeForStorage is accounts.Account#DecodeForStorage that returns false if it panics.
+func decodeForStorage(enc []byte, acc *accounts.Account) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return acc.DecodeForStorage(enc) == nil
+}
+
+func sameAccount(acc *account, expected *accounts.Account) bool {
+	return acc.nonce == expected.Nonce &&
+		acc.balance == expected.Balance &&
+		acc.incarnation == expected.Incarnation &&
+		acc.codeHash == expected.CodeHash &&
+		acc.hasCode() == !expected.IsEmptyCodeHash()
+}
+
+// TestDecodeAccount checks that decodeAccount decodes the accounts the same way as turbo-geth.
+func TestDecodeAccount(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var acc account
+
+	for i := 0; i < 10_000; i++ {
+		expected := randomAccount(r)
+		enc := make([]byte, expected.EncodingLengthForStorage())
+		expected.EncodeForStorage(enc)
+
+		if err := decodeAccount(enc, &acc); err != nil {
+			t.Fatalf("%x: %v", enc, err)
+		}
+		if !sameAccount(&acc, &expected) {
+			t.Fatalf("%x: decoded %+v, expected %+v", enc, acc, expected)
+		}
+	}
+
+	if err := decodeAccount(nil, &acc); err != nil || !reflect.DeepEqual(acc, account{codeHash: emptyCodeHash}) {
+		t.Errorf("unexpected empty account: %+v, %v", acc, err)
+	}
+}
+
+// TestDecodeAccountMalformed checks that decodeAccount never panics and that everything it decodes
+// is decoded the same way by turbo-geth.
+func TestDecodeAccountMalformed(t *testing.T) {
+	// valid encodings with the bytes changed, the tail cut or random bytes appended
+	mutate := func(seed int64, mutation uint8) bool {
+		r := rand.New(rand.NewSource(seed))
+
+		acc := randomAccount(r)
+		enc := make([]byte, acc.EncodingLengthForStorage())
+		acc.EncodeForStorage(enc)
+
+		switch mutation % 3 {
+		case 0:
+			enc[r.Intn(len(enc))] = byte(r.Intn(256))
+		case 1:
+			enc = enc[:r.Intn(len(enc))]
+		case 2:
+			enc = append(enc, randomBytes(r, r.Intn(8))...)
+		}
+
+		return checkDecodeAccount(t, enc)
+	}
+	if err := quick.Check(mutate, &quick.Config{MaxCount: 10_000}); err != nil {
+		t.Error(err)
+	}
+
+	// random bytes
+	if err := quick.Check(func(enc []byte) bool { return checkDecodeAccount(t, enc) }, &quick.Config{MaxCount: 10_000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func checkDecodeAccount(t *testing.T, enc []byte) bool {
+	var acc account
+	if err := decodeAccount(enc, &acc); err != nil {
+		// turbo-geth is less strict, so it still can decode it
+		return true
+	}
+
+	var expected accounts.Account
+	if !decodeForStorage(enc, &expected) || !sameAccount(&acc, &expected) {
+		t.Logf("%x: decoded %+v, expected %+v", enc, acc, expected)
+		return false
+	}
+	return true
+}
+
+func TestDecodeAccountAllocs(t *testing.T) {
+	expected := randomAccount(rand.New(rand.NewSource(1)))
+	expected.Nonce, expected.CodeHash = 1, common.HexToHash("0x01")
+	expected.Balance.SetUint64(1e18)
+	enc := make([]byte, expected.EncodingLengthForStorage())
+	expected.EncodeForStorage(enc)
+
+	var acc account
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := decodeAccount(enc, &acc); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("decodeAccount allocates %v times", allocs)
+	}
+}
@@ -0,0 +1,329 @@
+package supply
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// balanceEntrySize is the approximate memory (in bytes) that a single balance takes in the map.
+// (the key, the pointer, the uint256 value and the map overhead)
+const balanceEntrySize = 128
+
+const spilledBalancesBucket = "balances"
+
+// balanceEntry is an account in the store.
+type balanceEntry struct {
+	balance uint256.Int
+	// contract is true if the account has code
+	contract bool
+}
+
+// the spilled entries are stored as (flags | balance)
+const spilledContractFlag = 1
+
+// forEachBalance calls `fn` for the balances of a set of accounts, like balanceStore.forEach.
+type forEachBalance func(fn func(address common.Address, entry *balanceEntry) error) error
+
+// balanceStore contains the account balances of the backward calculation.
+// It keeps up to `limit` entries in memory, the rest is spilled to a scratch LMDB database in the tmp dir.
+// The memory works as a write-back cache of that database: the values read from the disk stay in memory
+// until the next spill, so they can be updated in place.
+//
+// `put` and `delete` must be called after `get` for the same address, that's how the store knows
+// if the entry is new.
+type balanceStore struct {
+	// memory contains the recently used balances, `nil` means that the entry is deleted but it still is on disk
+	memory map[common.Address]*balanceEntry
+	// limit is the max number of entries in memory, 0 means no limit
+	limit int
+	// size is the total number of entries (in memory and on disk)
+	size int
+
+	tmpDir string
+	dir    string
+	kv     ethdb.RwKV
+	// tx is the read transaction for the spilled entries, it is renewed after every spill
+	tx ethdb.Tx
+
+	// shards are set if the store is split by the first byte of the address (see shard),
+	// the entries are kept in them then and shardIndex maps the first byte to the shard.
+	shards     []*balanceStore
+	shardIndex *[256]uint8
+}
+
+// newBalanceStore creates the store that uses up to `memoryBudget` MB of memory, 0 means no limit.
+// The spilled entries are stored in `tmpDir`.
+func newBalanceStore(memoryBudget int, tmpDir string) *balanceStore {
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+
+	return &balanceStore{
+		memory: make(map[common.Address]*balanceEntry),
+		limit:  memoryBudget * 1024 * 1024 / balanceEntrySize,
+		tmpDir: tmpDir,
+	}
+}
+
+// shard splits the empty store into `n` (at most 256) stores with the key ranges [i*256/n, (i+1)*256/n)
+// of the first byte of the address and the memory budget split between them, so they can be filled
+// by different goroutines. The store passes all the calls to the shards afterwards.
+func (s *balanceStore) shard(n int) []*balanceStore {
+	s.shards = make([]*balanceStore, n)
+	s.shardIndex = new([256]uint8)
+
+	for i := range s.shards {
+		limit := s.limit / n
+		if s.limit > 0 && limit == 0 {
+			limit = 1
+		}
+		s.shards[i] = &balanceStore{memory: make(map[common.Address]*balanceEntry), limit: limit, tmpDir: s.tmpDir}
+
+		for b := i * 256 / n; b < (i+1)*256/n; b++ {
+			s.shardIndex[b] = uint8(i)
+		}
+	}
+
+	return s.shards
+}
+
+func (s *balanceStore) shardOf(address common.Address) *balanceStore {
+	return s.shards[s.shardIndex[address[0]]]
+}
+
+func (s *balanceStore) get(address common.Address) (*balanceEntry, bool, error) {
+	if s.shards != nil {
+		return s.shardOf(address).get(address)
+	}
+
+	if entry, ok := s.memory[address]; ok {
+		return entry, entry != nil, nil
+	}
+
+	if s.tx == nil {
+		// nothing is spilled yet
+		return nil, false, nil
+	}
+
+	v, err := s.tx.GetOne(spilledBalancesBucket, address[:])
+	if err != nil || v == nil {
+		return nil, false, err
+	}
+
+	entry := &balanceEntry{}
+	decodeSpilledEntry(v, entry)
+	s.memory[address] = entry
+
+	return entry, true, nil
+}
+
+func (s *balanceStore) put(address common.Address, entry *balanceEntry) error {
+	if s.shards != nil {
+		return s.shardOf(address).put(address, entry)
+	}
+
+	if existing, ok := s.memory[address]; !ok || existing == nil {
+		s.size++
+	}
+
+	s.memory[address] = entry
+
+	if s.limit > 0 && len(s.memory) > s.limit {
+		return s.spill()
+	}
+
+	return nil
+}
+
+func (s *balanceStore) delete(address common.Address) {
+	if s.shards != nil {
+		s.shardOf(address).delete(address)
+		return
+	}
+
+	if existing, ok := s.memory[address]; ok && existing != nil {
+		s.size--
+	}
+
+	if s.kv != nil {
+		// it still can be on disk
+		s.memory[address] = nil
+	} else {
+		delete(s.memory, address)
+	}
+}
+
+func (s *balanceStore) len() int {
+	size := s.size
+	for _, shard := range s.shards {
+		size += shard.len()
+	}
+	return size
+}
+
+// forEach calls `fn` for every entry in the store (in no particular order).
+func (s *balanceStore) forEach(fn func(address common.Address, entry *balanceEntry) error) error {
+	for _, shard := range s.shards {
+		if err := shard.forEach(fn); err != nil {
+			return err
+		}
+	}
+
+	if s.kv == nil {
+		for address, entry := range s.memory {
+			if err := fn(address, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// everything is on disk after the spill
+	if err := s.spill(); err != nil {
+		return err
+	}
+
+	c := s.tx.Cursor(spilledBalancesBucket)
+	defer c.Close()
+
+	var address common.Address
+	entry := &balanceEntry{}
+
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+
+		copy(address[:], k)
+		decodeSpilledEntry(v, entry)
+
+		if err = fn(address, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// spill moves all the entries from memory to the disk.
+func (s *balanceStore) spill() error {
+	if s.kv == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+
+	// sorted keys are inserted way faster
+	addresses := make([]common.Address, 0, len(s.memory))
+	for address := range s.memory {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
+
+	err := s.kv.Update(context.Background(), func(tx ethdb.RwTx) error {
+		c := tx.RwCursor(spilledBalancesBucket)
+		defer c.Close()
+
+		for _, address := range addresses {
+			entry := s.memory[address]
+			if entry == nil {
+				if err := c.Delete(address[:], nil); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := c.Put(address[:], encodeSpilledEntry(entry)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.memory = make(map[common.Address]*balanceEntry)
+
+	s.tx, err = s.kv.Begin(context.Background())
+	return err
+}
+
+func encodeSpilledEntry(entry *balanceEntry) []byte {
+	var flags byte
+	if entry.contract {
+		flags |= spilledContractFlag
+	}
+	return append([]byte{flags}, entry.balance.Bytes()...)
+}
+
+func decodeSpilledEntry(v []byte, entry *balanceEntry) {
+	entry.contract = v[0]&spilledContractFlag != 0
+	entry.balance.SetBytes(v[1:])
+}
+
+func (s *balanceStore) open() error {
+	if err := os.MkdirAll(s.tmpDir, 0755); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(s.tmpDir, "supply-balances-")
+	if err != nil {
+		return err
+	}
+
+	log.Info("Account balances don't fit into the memory budget, spilling them to disk", "dir", dir, "entries", len(s.memory))
+
+	kv, err := ethdb.NewLMDB().Path(dir).WithBucketsConfig(func(dbutils.BucketsCfg) dbutils.BucketsCfg {
+		return dbutils.BucketsCfg{spilledBalancesBucket: {}}
+	}).Open()
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	s.dir = dir
+	s.kv = kv
+	return nil
+}
+
+// close removes the spilled entries.
+func (s *balanceStore) close() {
+	for _, shard := range s.shards {
+		shard.close()
+	}
+	s.shards = nil
+
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+
+	if s.kv != nil {
+		s.kv.Close()
+		s.kv = nil
+
+		if err := os.RemoveAll(s.dir); err != nil {
+			log.Warn("Can't remove the spilled balances", "dir", s.dir, "err", err)
+		}
+	}
+
+	s.memory = nil
+}
@@ -0,0 +1,76 @@
+package supply
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+)
+
+// TestBalanceStoreSpill runs the backward calculation with the smallest memory budget (1 MB, 8192 balances),
+// the test chain has more accounts than that, so the balances are spilled to disk both while reading
+// the current state (sequentially and in shards) and while replaying the changesets.
+func TestBalanceStoreSpill(t *testing.T) {
+	db := newTestChain(t, 20, 1000, 20000)
+	if err := stages.SaveStageProgress(db, stages.Execution, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	spilled := BackwardConfig{MemoryBudget: 1, TmpDir: tmpDir}
+
+	// the current state
+	expectedTotals, expected := readBalances(t, db, 20, BackwardConfig{})
+	if limit := newBalanceStore(1, "").limit; len(expected) <= limit {
+		t.Fatalf("the test chain should have more than %d accounts, got %d", limit, len(expected))
+	}
+
+	accountBalances := newBalanceStore(spilled.MemoryBudget, spilled.TmpDir)
+	totals := &Totals{}
+	if err := readCurrentState(db, 20, spilled, accountBalances, totals); err != nil {
+		t.Fatal(err)
+	}
+	if accountBalances.kv == nil {
+		t.Fatal("expected the balances to be spilled")
+	}
+	accountBalances.close()
+
+	totals, balances := readBalances(t, db, 20, spilled)
+	compareBalances(t, "spilled", totals, expectedTotals, balances, expected)
+
+	// every shard spills its part of the balances
+	sharded := spilled
+	sharded.Workers, sharded.KV = 4, db.RwKV()
+	totals, balances = readBalances(t, db, 20, sharded)
+	compareBalances(t, "spilled shards", totals, expectedTotals, balances, expected)
+
+	// the replay updates and deletes the spilled balances
+	var expectedBlocks []Totals
+	err := calculateBackward(db, 1, 20, BackwardConfig{}, func(_ uint64, totals *Totals) error {
+		expectedBlocks = append(expectedBlocks, *totals)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := 0
+	err = calculateBackward(db, 1, 20, spilled, func(blockNumber uint64, totals *Totals) error {
+		if *totals != expectedBlocks[i] {
+			t.Errorf("block %d: totals %+v, expected %+v", blockNumber, totals, &expectedBlocks[i])
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(expectedBlocks) {
+		t.Errorf("calculated %d blocks, expected %d", i, len(expectedBlocks))
+	}
+
+	// the spilled balances are removed
+	if files, err := ioutil.ReadDir(tmpDir); err != nil || len(files) != 0 {
+		t.Errorf("expected the tmp dir to be empty, got %d files (%v)", len(files), err)
+	}
+}
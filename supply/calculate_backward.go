@@ -2,23 +2,25 @@ package supply
 
 import (
 	"fmt"
+	"time"
 
-	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
-
-	"golang.org/x/text/language"
-	"golang.org/x/text/message"
 )
 
 func isAccount(k []byte) bool {
 	return len(k) == 20
 }
 
-func CalculateBackward(db ethdb.Database, from, to uint64) error {
+// CalculateBackward calculates the ETH supply between blocks `from` and `to` backward in time.
+// (from the larger block to the smaller one)
+// It reads the whole current state first (that is slow), and then applies changesets to it, that is fast.
+// `to` should be the block of the current state (the progress of the Execution stage).
+// The progress is saved in checkpoints, so an interrupted calculation can be continued with ResumeBackward.
+func CalculateBackward(db ethdb.Database, from, to uint64, cfg BackwardConfig) error {
 	var err error
 
 	// adjust the initial position based on what we have in the DB
@@ -28,65 +30,148 @@ func CalculateBackward(db ethdb.Database, from, to uint64) error {
 		return err
 	}
 
-	blockNumber := to
+	accountBalances := newBalanceStore(cfg.MemoryBudget, cfg.TmpDir)
+	defer accountBalances.close()
 
-	accountBalances := make(map[common.Address]*uint256.Int)
+	totals := &Totals{}
 
-	p := message.NewPrinter(language.English)
+	progress := newProgress(StrategyBackward, to-from+1, 100_000)
+	defer progress.finish()
 
-	totalSupply := uint256.NewInt()
+	log.Info("Calculating supply for the current state (will be slow)")
+	start := time.Now()
 
-	for blockNumber >= from {
-		if blockNumber == to {
-			log.Info("Calculating supply for the current state (will be slow)")
-			processed := 0
-			err := db.Walk(dbutils.PlainStateBucket, nil, 0, func(k, v []byte) (bool, error) {
-				if !isAccount(k) {
-					// for storage entries we just continue
-					return true, nil
-				}
+	err = readCurrentState(db, to, cfg, accountBalances, totals)
+	if err != nil {
+		return err
+	}
 
-				address := common.BytesToAddress(k)
+	scanDuration := time.Since(start)
 
-				err := decodeAccountAndUpdateBalance(v, address, accountBalances, totalSupply)
-				if err != nil {
-					return false, err
-				}
+	checkpointer := &backwardCheckpointer{db: db, cfg: cfg, from: from, to: to, balances: accountBalances}
 
-				processed++
-				if processed%100000 == 0 {
-					log.Info(p.Sprintf("Processed %d account records in current state\n", processed))
-				}
+	start = time.Now()
 
-				return true, nil
-			})
-			if err != nil {
-				return err
-			}
-		} else {
+	err = replayBackward(db, from, to, cfg.Watchlist, accountBalances, totals, progress.track(checkpointer.onBlock))
+	if err != nil {
+		return err
+	}
+
+	err = recordThroughput(db, func(throughput *Throughput) {
+		throughput.setScan(uint64(accountBalances.len()), scanDuration)
+		throughput.addReplay(to-from+1, time.Since(start))
+	})
+	if err != nil {
+		return err
+	}
+
+	return DeleteBackwardCheckpoint(db)
+}
+
+// ResumeBackward continues the backward calculation from the checkpoint.
+// The blocks after the end of the interrupted calculation (up to `to`, the current state)
+// are calculated forward. If the balances snapshot doesn't match the checkpoint,
+// the checkpoint is discarded and the range is calculated backward from the current state.
+func ResumeBackward(db ethdb.Database, checkpoint *BackwardCheckpoint, to uint64, cfg BackwardConfig) error {
+	accountBalances := newBalanceStore(cfg.MemoryBudget, cfg.TmpDir)
+	defer accountBalances.close()
+
+	// the totals are calculated from the balances, including the supply (that is in the checkpoint too)
+	totals := &Totals{}
+
+	err := readBalancesSnapshot(checkpoint.Snapshot, cfg.Watchlist, accountBalances, totals)
+	if err == nil && !totals.Supply.Eq(&checkpoint.TotalSupply) {
+		err = fmt.Errorf("the supply of the snapshot is %d, expected %d", &totals.Supply, &checkpoint.TotalSupply)
+	}
+	if err != nil {
+		// the snapshot is left from another calculation or is damaged, so we start over
+		log.Warn("Discarding the supply checkpoint, can't use the balances snapshot", "block", checkpoint.BlockNumber, "err", err)
+		accountBalances.close()
+
+		if err = DeleteBackwardCheckpoint(db); err != nil {
+			return err
+		}
+		return CalculateBackward(db, checkpoint.From, to, cfg)
+	}
+
+	checkpointer := &backwardCheckpointer{db: db, cfg: cfg, from: checkpoint.From, to: checkpoint.To, balances: accountBalances, last: checkpoint}
+
+	progress := newProgress(StrategyBackward, checkpoint.BlockNumber-checkpoint.From+1, 100_000)
+
+	start := time.Now()
+
+	err = replayBackward(db, checkpoint.From, checkpoint.BlockNumber, cfg.Watchlist, accountBalances, totals, progress.track(checkpointer.onBlock))
+	progress.finish()
+	if err != nil {
+		return err
+	}
+
+	err = recordThroughput(db, func(throughput *Throughput) {
+		throughput.addReplay(checkpoint.BlockNumber-checkpoint.From+1, time.Since(start))
+	})
+	if err != nil {
+		return err
+	}
+
+	// the state moved on while the calculation was interrupted
+	if to > checkpoint.To {
+		err = CalculateForward(db, nil, checkpoint.To+1, to, cfg.Config)
+		if err != nil {
+			return err
+		}
+	}
+
+	return DeleteBackwardCheckpoint(db)
+}
+
+// calculateBackward calculates the ETH supply for blocks `to`...`from` and passes it to `onBlock`.
+func calculateBackward(db ethdb.Database, from, to uint64, cfg BackwardConfig, onBlock func(blockNumber uint64, totals *Totals) error) error {
+	accountBalances := newBalanceStore(cfg.MemoryBudget, cfg.TmpDir)
+	defer accountBalances.close()
+
+	totals := &Totals{}
+
+	log.Info("Calculating supply for the current state (will be slow)")
+	err := readCurrentState(db, to, cfg, accountBalances, totals)
+	if err != nil {
+		return err
+	}
+
+	return replayBackward(db, from, to, cfg.Watchlist, accountBalances, totals, onBlock)
+}
+
+// replayBackward applies changesets to the state at the block `to` down to the block `from`
+// and passes the totals of every block to `onBlock`.
+// * accountBalances, totals - the state at the block `to`, they are updated in place.
+// The holders are counted from accountBalances, so totals.Holders doesn't have to be set.
+func replayBackward(db ethdb.Database, from, to uint64, watchlist Watchlist, accountBalances *balanceStore, totals *Totals, onBlock func(blockNumber uint64, totals *Totals) error) error {
+	var err error
+
+	blockNumber := to
+
+	for blockNumber >= from {
+		if blockNumber < to {
 			// to get the state for blockNumber if we have the state for blockNuber + 1
 			// we need to apply changesets by key blockNumber + 1 to the state
 			changesetKey := dbutils.EncodeBlockNumber(blockNumber + 1)
 
 			err = changeset.Walk(db, dbutils.PlainAccountChangeSetBucket, changesetKey, 8*8, func(blockN uint64, k, v []byte) (bool, error) {
 				address := common.BytesToAddress(k)
-				innerErr := decodeAccountAndUpdateBalance(v, address, accountBalances, totalSupply)
+				innerErr := decodeAccountAndUpdateBalance(v, address, watchlist, accountBalances, totals)
 				if innerErr == nil {
 					return true, nil
 				}
 				return false, innerErr
 			})
+			if err != nil {
+				return err
+			}
 		}
 
-		ethHoldersCount := len(accountBalances) // those who have non-zero balance
+		// only the accounts with non-zero balance are kept
+		totals.Holders = uint64(accountBalances.len())
 
-		if blockNumber%100_000 == 0 {
-			// this could be used to compare data with
-			// https://github.com/lastmjs/eth-total-supply#total-eth-supply
-			log.Info(p.Sprintf("Stats: blockNum=%d\n\ttotal accounts with non zero balance=%d\n\tsupply=%d", blockNumber, ethHoldersCount, totalSupply))
-		}
-
-		if err := SetSupplyForBlock(db, blockNumber, totalSupply); err != nil {
+		if err := onBlock(blockNumber, totals); err != nil {
 			return err
 		}
 
@@ -100,80 +185,43 @@ func CalculateBackward(db ethdb.Database, from, to uint64) error {
 	return nil
 }
 
-// inspired by accounts.Account#DecodeForStorage, but way more light weight
-// it uses some knowledge about how turbo-geth stores accounts
-// but it makes the operations with very good performance
-func decodeAccountAndUpdateBalance(enc []byte, address common.Address, balances map[common.Address]*uint256.Int, totalSupply *uint256.Int) error {
-	// if an account was removed...
-	if len(enc) == 0 {
-		// if it was in the list...
-		if balance, ok := balances[address]; ok && balance != nil {
-			// decrease total supply
-			totalSupply.Sub(totalSupply, balance)
-			// remove the account from the list of balances
-			delete(balances, address)
-		}
-		return nil
+// decodeAccountAndUpdateBalance applies the account data to the balance of the account in the store.
+// * totals - they are updated with the change of the balance.
+func decodeAccountAndUpdateBalance(enc []byte, address common.Address, watchlist Watchlist, balances *balanceStore, totals *Totals) error {
+	entry, ok, err := balances.get(address)
+	if err != nil {
+		return err
 	}
 
-	var fieldSet = enc[0]
-
-	// if an account has 0 balance...
-	if fieldSet&2 <= 0 {
-		// ...and it had some balance before
-		if balance, ok := balances[address]; ok && balance != nil {
-			// set it to 0 and update the value
-			totalSupply.Sub(totalSupply, balance)
-
-			balance.Clear()
-			balances[address] = balance
-		}
-		return nil
+	var acc account
+	if err = decodeAccount(enc, &acc); err != nil {
+		return err
 	}
 
-	var pos = 1
-
-	if fieldSet&1 > 0 {
-		decodeLength := int(enc[pos])
+	// remove the old value
+	if ok {
+		totals.remove(&entry.balance, entry.contract, watchlist.Contains(address))
+	}
 
-		if len(enc) < pos+decodeLength+1 {
-			return fmt.Errorf(
-				"malformed CBOR for Account.Nonce: %s, Length %d",
-				enc[pos+1:], decodeLength)
+	// only the accounts with non-zero balance are kept
+	if acc.balance.IsZero() {
+		if ok {
+			balances.delete(address)
 		}
-
-		pos += decodeLength + 1
+		return nil
 	}
 
-	decodeLength := int(enc[pos])
-
-	if len(enc) < pos+decodeLength+1 {
-		return fmt.Errorf(
-			"malformed CBOR for Account.Nonce: %s, Length %d",
-			enc[pos+1:], decodeLength)
+	if !ok {
+		entry = &balanceEntry{}
 	}
 
-	// update existing balance if we found it
-	if balance, ok := balances[address]; ok && balance != nil {
-		// remove the old value
-		totalSupply.Sub(totalSupply, balance)
-
-		// update value in-place so we don't overload the GC
-		balance.SetBytes(enc[pos+1 : pos+decodeLength+1])
+	// update the entry in-place so we don't overload the GC
+	entry.balance.Set(&acc.balance)
+	entry.contract = acc.hasCode()
 
-		// add the new value
-		totalSupply.Add(totalSupply, balance)
+	// add the new value
+	totals.add(&entry.balance, entry.contract, watchlist.Contains(address))
 
-		// and update the map
-		balances[address] = balance
-		return nil
-	}
-
-	// add a new entry to if there wasn't an existing one
-	balance := uint256.NewInt().SetBytes(enc[pos+1 : pos+decodeLength+1])
-	balances[address] = balance
-
-	totalSupply.Add(totalSupply, balance)
-
-	return nil
+	// and update the store
+	return balances.put(address, entry)
 }
@@ -1,178 +1,500 @@
 package supply
 
 import (
-	"context"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/core"
 	"github.com/ledgerwatch/turbo-geth/core/state"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
-	"github.com/ledgerwatch/turbo-geth/log"
-
-	"golang.org/x/text/language"
-	"golang.org/x/text/message"
 )
 
 // CalculateForwards calculates the ETH supply between blocks `from` and `to` forward in time.
 // (from the smaller block to the larger one)
 // It is more efficient for the smaller block gaps because it doesn't calculate the current state supply.
-// On larger block gaps it is inefficient because of many DB calls.
-func CalculateForward(db ethdb.Database, from, to uint64) error {
+// On larger block gaps it is inefficient because it reads the changesets of the whole range.
+// * genesis - the genesis specification to calculate the supply at block 0, `nil` to detect it from the DB.
+// * cfg - the balance histogram is stored every `cfg.HistogramInterval` blocks and for the block `to`.
+func CalculateForward(db ethdb.Database, genesis *core.Genesis, from, to uint64, cfg Config) error {
 	if from > to {
 		from, to = to, from
 	}
 
-	var err error
+	from, totals, err := initialTotals(db, from, cfg)
+	if err != nil {
+		return err
+	}
+
+	if from > 0 {
+		if err = deleteTipHistogram(db, from-1, cfg); err != nil {
+			return err
+		}
+	}
+
+	progress := newProgress(StrategyForward, to-from+1, 10_000)
+	defer progress.finish()
 
-	p := message.NewPrinter(language.English)
+	return calculateForwardWithProgress(db, genesis, from, to, cfg, totals, progress)
+}
 
-	totalSupply := uint256.NewInt()
+// initialTotals returns the block the forward calculation starts from and the totals for the block before it.
+// It doesn't write anything.
+func initialTotals(db ethdb.Database, from uint64, cfg Config) (uint64, *Totals, error) {
+	totals := &Totals{}
 
 	// adjust the initial position based on what we have in the DB
 	// calculating forward from N to M depends on supply for the block N-1 being present in the DB
 	// (so it doesn't have to recalculate everything from genesis over and over again)
-	from, err = GetInitialPosition(db, from, totalSupply)
+	if from > 0 {
+		lastCalculated, err := GetInitialPosition(db, from-1, &totals.Supply)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if lastCalculated > 0 {
+			totals.Holders, err = GetHolderCountForBlock(db, lastCalculated)
+			if err != nil {
+				return 0, nil, fmt.Errorf("no holder count for the block %d: %w", lastCalculated, err)
+			}
+
+			contractSupply, err := GetContractSupplyForBlock(db, lastCalculated)
+			if err != nil {
+				return 0, nil, fmt.Errorf("no contract supply for the block %d: %w", lastCalculated, err)
+			}
+			totals.ContractSupply.Set(contractSupply)
+
+			lockedSupply, err := GetLockedSupplyForBlock(db, lastCalculated)
+			if err != nil {
+				return 0, nil, fmt.Errorf("no locked supply for the block %d: %w", lastCalculated, err)
+			}
+			totals.LockedSupply.Set(lockedSupply)
+
+			histogram, err := histogramAt(db, lastCalculated)
+			if err != nil {
+				return 0, nil, fmt.Errorf("no balance histogram for the block %d: %w", lastCalculated, err)
+			}
+			totals.Histogram = *histogram
+
+			from = lastCalculated + 1
+		} else {
+			// nothing is calculated, start from genesis
+			from = 0
+		}
+	}
+
+	return from, totals, nil
+}
+
+// deleteTipHistogram removes the balance histogram of the last calculated block
+// if it was stored only because it was the last one.
+func deleteTipHistogram(db ethdb.Database, blockNumber uint64, cfg Config) error {
+	if storesHistogram(blockNumber, cfg.HistogramInterval) {
+		return nil
+	}
+	return DeleteHistogramForBlock(db, blockNumber)
+}
+
+// calculateForwardWithProgress is CalculateForward from the totals returned by initialTotals
+// that is tracked by the progress of a larger calculation.
+func calculateForwardWithProgress(db ethdb.Database, genesis *core.Genesis, from, to uint64, cfg Config, totals *Totals, progress *progress) error {
+	start := time.Now()
+
+	err := calculateForward(db, genesis, from, to, cfg.Watchlist, totals, progress.track(func(blockNumber uint64, totals *Totals) error {
+		return setTotalsForBlock(db, blockNumber, totals, blockNumber == to || storesHistogram(blockNumber, cfg.HistogramInterval))
+	}))
 	if err != nil {
 		return err
 	}
 
-	for blockNumber := from; blockNumber <= to; blockNumber++ {
-		if blockNumber == 0 {
-			// calc from genesis
-			err = calculateAtGenesis(db, totalSupply)
-		} else {
-			err = calculateAtBlock(db, blockNumber, totalSupply)
-		}
+	err = recordThroughput(db, func(throughput *Throughput) {
+		throughput.addForward(to-from+1, time.Since(start))
+	})
+	if err != nil {
+		return err
+	}
+
+	return storeAtTip(db, to, cfg)
+}
+
+// storeAtTip stores the values that need the balances of all the accounts for the block `to` if it is the tip
+// (the current state is the state after it) and it passed the next interval after the last stored value.
+func storeAtTip(db ethdb.Database, to uint64, cfg Config) error {
+	storesRichList, err := passedInterval(db, RichListBucketName, to, cfg.RichListInterval)
+	if err != nil {
+		return err
+	}
+	storesRichList = storesRichList && cfg.RichListSize > 0
 
+	storesConcentration, err := passedInterval(db, ConcentrationBucketName, to, cfg.ConcentrationInterval)
+	if err != nil || !storesRichList && !storesConcentration {
+		return err
+	}
+
+	var changedAfter bool
+	err = withTx(db, func(tx ethdb.Tx) error {
+		changedAfter, err = stateChangedAfter(tx, to)
+		return err
+	})
+	if err != nil || changedAfter {
+		return err
+	}
+
+	if storesRichList {
+		list, err := topBalances(currentStateBalances(db), cfg.RichListSize)
 		if err != nil {
 			return err
 		}
 
-		err = SetSupplyForBlock(db, blockNumber, totalSupply)
+		if err = SetRichListForBlock(db, to, list); err != nil {
+			return err
+		}
+	}
+
+	if storesConcentration {
+		concentration, err := calculateConcentration(currentStateBalances(db))
 		if err != nil {
 			return err
 		}
 
-		if blockNumber%10_000 == 0 {
-			// this could be used to compare data with
-			// https://github.com/lastmjs/eth-total-supply#total-eth-supply
-			log.Info(p.Sprintf("Stats: blockNum=%d\n\tsupply=%d", blockNumber, totalSupply))
+		if err = SetConcentrationForBlock(db, to, concentration); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-var (
-	oldBalanceBuffer = uint256.NewInt()
-	newBalanceBuffer = uint256.NewInt()
-)
+// passedInterval returns true if there is a multiple of `interval` after the last block stored in the bucket
+// up to `blockNumber` or if nothing is stored, 0 disables the interval.
+func passedInterval(db ethdb.Getter, bucket string, blockNumber, interval uint64) (bool, error) {
+	if interval == 0 {
+		return false, nil
+	}
 
-func calculateAtBlock(db ethdb.Database, blockNumber uint64, totalSupply *uint256.Int) error {
-	changesetKey := dbutils.EncodeBlockNumber(blockNumber)
+	var passed bool
+	err := withTx(db, func(tx ethdb.Tx) error {
+		k, _, err := seekAtOrBefore(tx, bucket, blockNumber)
+		if err == ethdb.ErrKeyNotFound {
+			passed = true
+			return nil
+		} else if err != nil {
+			return err
+		}
 
-	errWalk := changeset.Walk(db, dbutils.PlainAccountChangeSetBucket, changesetKey, 8*8, func(blockN uint64, k, accountDataBeforeBlock []byte) (bool, error) {
-		err := decodeAccountBalanceTo(accountDataBeforeBlock, oldBalanceBuffer)
-		if err != nil {
-			return false, err
+		passed = binary.BigEndian.Uint64(k)/interval < blockNumber/interval
+		return nil
+	})
+	return passed, err
+}
+
+// stateChangedAfter returns true if the current state isn't the state after the block `blockNumber`,
+// that is if there are changesets after it.
+func stateChangedAfter(tx ethdb.Tx, blockNumber uint64) (bool, error) {
+	c := tx.Cursor(dbutils.PlainAccountChangeSetBucket)
+	defer c.Close()
+
+	k, _, err := c.Seek(dbutils.EncodeBlockNumber(blockNumber + 1))
+	return k != nil, err
+}
+
+// calculateForward calculates the ETH supply for blocks `from`...`to` and passes it to `onBlock`.
+// * watchlist - the accounts that are counted in the locked supply.
+// * totals - should contain the totals for the block `from-1`, they are updated in place.
+func calculateForward(db ethdb.Database, genesis *core.Genesis, from, to uint64, watchlist Watchlist, totals *Totals, onBlock func(blockNumber uint64, totals *Totals) error) error {
+	if from == 0 {
+		// calc from genesis
+		if err := calculateAtGenesis(db, genesis, watchlist, totals); err != nil {
+			return err
 		}
 
-		var accountDataAfterBlock []byte
-		accountDataAfterBlock, err = getAsOf(db, false, k, blockNumber+1)
-		if err != nil && err != ethdb.ErrKeyNotFound {
-			fmt.Println("err in get as of", err)
-			return false, err
+		if err := onBlock(0, totals); err != nil {
+			return err
+		}
+
+		from = 1
+	}
+
+	if from > to {
+		return nil
+	}
+
+	return forEachDelta(db, from, to, watchlist, func(blockNumber uint64, delta *supplyDelta) error {
+		delta.applyTo(totals)
+		return onBlock(blockNumber, totals)
+	})
+}
+
+// supplyDelta is the change of the totals in a single block.
+// supply(N) = supply(N-1) + increase - decrease
+type supplyDelta struct {
+	// increase is the sum of the balances after the block of the accounts changed in it.
+	increase uint256.Int
+	// decrease is the sum of the balances before the block of the accounts changed in it.
+	decrease uint256.Int
+	// contractIncrease and contractDecrease are the same for the contract accounts only.
+	contractIncrease uint256.Int
+	contractDecrease uint256.Int
+	// lockedIncrease and lockedDecrease are the same for the accounts in the watchlist only.
+	lockedIncrease uint256.Int
+	lockedDecrease uint256.Int
+	// holders is the change of the number of accounts with non-zero balance.
+	holders int64
+	// histogram is the change of the number of accounts in every balance range.
+	histogram [HistogramBuckets]int64
+}
+
+// add adds the balance of an account after the block.
+func (d *supplyDelta) add(balance *uint256.Int, contract, locked bool) {
+	d.increase.Add(&d.increase, balance)
+	if contract {
+		d.contractIncrease.Add(&d.contractIncrease, balance)
+	}
+	if locked {
+		d.lockedIncrease.Add(&d.lockedIncrease, balance)
+	}
+	if !balance.IsZero() {
+		d.holders++
+		d.histogram[histogramBucket(balance)]++
+	}
+}
+
+// remove removes the balance of an account before the block.
+func (d *supplyDelta) remove(balance *uint256.Int, contract, locked bool) {
+	d.decrease.Add(&d.decrease, balance)
+	if contract {
+		d.contractDecrease.Add(&d.contractDecrease, balance)
+	}
+	if locked {
+		d.lockedDecrease.Add(&d.lockedDecrease, balance)
+	}
+	if !balance.IsZero() {
+		d.holders--
+		d.histogram[histogramBucket(balance)]--
+	}
+}
+
+func (d *supplyDelta) applyTo(totals *Totals) {
+	totals.Supply.Add(&totals.Supply, &d.increase)
+	totals.Supply.Sub(&totals.Supply, &d.decrease)
+	totals.ContractSupply.Add(&totals.ContractSupply, &d.contractIncrease)
+	totals.ContractSupply.Sub(&totals.ContractSupply, &d.contractDecrease)
+	totals.LockedSupply.Add(&totals.LockedSupply, &d.lockedIncrease)
+	totals.LockedSupply.Sub(&totals.LockedSupply, &d.lockedDecrease)
+	totals.Holders = uint64(int64(totals.Holders) + d.holders)
+	d.applyToHistogram(&totals.Histogram)
+}
+
+func (d *supplyDelta) applyToHistogram(histogram *Histogram) {
+	for i, change := range d.histogram {
+		histogram[i] = uint64(int64(histogram[i]) + change)
+	}
+}
+
+// deltasBatchSize is the max number of blocks which supply changes are kept in memory at once (see forEachDelta).
+var deltasBatchSize uint64 = 10_000
+
+// forEachDelta calls `fn` with the supply change of every block `from`...`to` in order,
+// it is calculated in one sequential pass over the changesets.
+//
+// A changeset of the block N contains the balances before the block N. The balance after the block N
+// is the balance before the next change of the account, so the change of the block N is passed to `fn`
+// when the next changes of all of its accounts are read. The accounts that don't change again up to the block `to`
+// get their balances after it from the current state (or from the history if the state is ahead of `to`).
+//
+// At most deltasBatchSize blocks are kept in memory, so the memory doesn't depend on the size of the range.
+// If an account doesn't change again in that many blocks, its balance is looked up in the history.
+// * watchlist - the accounts that are counted in the locked supply, can be nil.
+func forEachDelta(db ethdb.Getter, from, to uint64, watchlist Watchlist, fn func(blockNumber uint64, delta *supplyDelta) error) error {
+	return withTx(db, func(tx ethdb.Tx) error {
+		w := &deltaWalker{
+			tx:          tx,
+			watchlist:   watchlist,
+			fn:          fn,
+			first:       from,
+			lastChanged: make(map[common.Address]uint64),
 		}
 
-		err = decodeAccountBalanceTo(accountDataAfterBlock, newBalanceBuffer)
+		err := changeset.Walk(ethdb.NewRoTxDb(tx), dbutils.PlainAccountChangeSetBucket, dbutils.EncodeBlockNumber(from), 0, func(blockN uint64, k, accountDataBeforeBlock []byte) (bool, error) {
+			if blockN > to {
+				return false, nil
+			}
+
+			if err := w.extend(blockN); err != nil {
+				return false, err
+			}
+
+			return true, w.change(blockN, common.BytesToAddress(k), accountDataBeforeBlock)
+		})
 		if err != nil {
-			return false, err
+			return err
 		}
 
-		totalSupply.Sub(totalSupply, oldBalanceBuffer)
-		totalSupply.Add(totalSupply, newBalanceBuffer)
+		if err = w.extend(to); err != nil {
+			return err
+		}
 
-		return true, nil
+		return w.finish(to)
 	})
-	return errWalk
 }
 
-func calculateAtGenesis(db ethdb.Database, totalSupply *uint256.Int) error {
-	genesis := core.DefaultGenesisBlock()
+// pendingBlock is the supply change of a block that isn't passed on yet.
+type pendingBlock struct {
+	delta supplyDelta
+	// accounts are the accounts changed in the block, `unknown` of them don't have the balance after the block yet
+	accounts []common.Address
+	unknown  int
+}
+
+// deltaWalker keeps the blocks of forEachDelta from the first one that isn't passed on yet.
+type deltaWalker struct {
+	tx        ethdb.Tx
+	watchlist Watchlist
+	fn        func(blockNumber uint64, delta *supplyDelta) error
+
+	blocks []pendingBlock
+	// first is the block number of blocks[0]
+	first uint64
+	// lastChanged is the last block where an account changed, while its balance after that block is unknown
+	lastChanged map[common.Address]uint64
+
+	acc account
+}
+
+// extend adds the blocks up to `blockNumber` and passes on the blocks before it that are complete.
+func (w *deltaWalker) extend(blockNumber uint64) error {
+	for w.first+uint64(len(w.blocks)) <= blockNumber {
+		w.blocks = append(w.blocks, pendingBlock{})
+	}
+
+	if err := w.flush(blockNumber); err != nil {
+		return err
+	}
+
+	for uint64(len(w.blocks)) > deltasBatchSize {
+		// the accounts of the first block didn't change for a while
+		for _, address := range w.blocks[0].accounts {
+			if w.lastChanged[address] != w.first {
+				continue
+			}
+			accountData, err := state.GetAsOf(w.tx, false, address[:], w.first+1)
+			if err != nil && err != ethdb.ErrKeyNotFound {
+				return err
+			}
+			if err = w.resolve(address, w.first, accountData); err != nil {
+				return err
+			}
+			delete(w.lastChanged, address)
+		}
 
-	for _, account := range genesis.Alloc {
-		balance, overflow := uint256.FromBig(account.Balance)
-		if overflow {
-			panic("overflows should not happen in genesis")
+		if err := w.flush(blockNumber); err != nil {
+			return err
 		}
-		totalSupply.Add(totalSupply, balance)
 	}
 
 	return nil
 }
 
-// getAsOf is a wrapper for state.GetAsOf for the staged sync.
-// we not always are getting `ethdb.KV`, sometimes we are getting `ethdb.Tx`
-// this code figures out what object do we get and calls a the right method.
-func getAsOf(db ethdb.Database, storage bool, key []byte, timestamp uint64) ([]byte, error) {
-	var accData []byte
-	var err error
-	if txHolder, ok := db.(ethdb.HasTx); ok {
-		accData, err = state.GetAsOf(txHolder.Tx(), false, key, timestamp)
-	} else if kvDB, ok := db.(*ethdb.ObjectDatabase); ok {
-		tx, err := kvDB.RwKV().BeginRw(context.TODO())
-		if err != nil {
-			return nil, err
+// change adds an account from the changeset of the block `blockNumber`.
+func (w *deltaWalker) change(blockNumber uint64, address common.Address, accountDataBeforeBlock []byte) error {
+	// the balance before this block is the balance after the previous change
+	if previous, ok := w.lastChanged[address]; ok {
+		if err := w.resolve(address, previous, accountDataBeforeBlock); err != nil {
+			return err
 		}
-		defer tx.Commit(context.TODO())
-		accData, err = state.GetAsOf(tx, false, key, timestamp)
-	} else {
-		panic(fmt.Sprintf("should be a TX or a object database, got %T %+v", db, db))
 	}
-	return accData, err
+
+	if err := decodeAccount(accountDataBeforeBlock, &w.acc); err != nil {
+		return err
+	}
+
+	block := &w.blocks[blockNumber-w.first]
+	block.delta.remove(&w.acc.balance, w.acc.hasCode(), w.watchlist.Contains(address))
+	block.accounts = append(block.accounts, address)
+	block.unknown++
+
+	w.lastChanged[address] = blockNumber
+	return nil
 }
 
-// inspired by accounts.Account#DecodeForStorage, but way more light weight
-// it uses some knowledge about how turbo-geth stores accounts
-// but it makes the operations with very good performance
-func decodeAccountBalanceTo(enc []byte, to *uint256.Int) error {
-	to.Clear()
-	if len(enc) == 0 {
-		return nil
+// resolve adds the balance of the account after the block `blockNumber`.
+func (w *deltaWalker) resolve(address common.Address, blockNumber uint64, accountDataAfterBlock []byte) error {
+	if err := decodeAccount(accountDataAfterBlock, &w.acc); err != nil {
+		return err
 	}
 
-	var fieldSet = enc[0]
+	block := &w.blocks[blockNumber-w.first]
+	block.delta.add(&w.acc.balance, w.acc.hasCode(), w.watchlist.Contains(address))
+	block.unknown--
+	return nil
+}
 
-	// if an account has 0 balance...
-	if fieldSet&2 <= 0 {
-		return nil
+// flush passes on the complete blocks before `blockNumber`.
+func (w *deltaWalker) flush(blockNumber uint64) error {
+	for len(w.blocks) > 0 && w.first < blockNumber && w.blocks[0].unknown == 0 {
+		if err := w.fn(w.first, &w.blocks[0].delta); err != nil {
+			return err
+		}
+		w.blocks[0] = pendingBlock{}
+		w.blocks = w.blocks[1:]
+		w.first++
 	}
+	return nil
+}
 
-	var pos = 1
+// finish adds the balances after the block `to` of the accounts that didn't change since their last change
+// and passes on the rest of the blocks.
+func (w *deltaWalker) finish(to uint64) error {
+	changedAfter, err := stateChangedAfter(w.tx, to)
+	if err != nil {
+		return err
+	}
 
-	if fieldSet&1 > 0 {
-		decodeLength := int(enc[pos])
+	// the state is read in the key order
+	addresses := make([]common.Address, 0, len(w.lastChanged))
+	for address := range w.lastChanged {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
 
-		if len(enc) < pos+decodeLength+1 {
-			return fmt.Errorf(
-				"malformed CBOR for Account.Nonce: %s, Length %d",
-				enc[pos+1:], decodeLength)
+	for _, address := range addresses {
+		var accountData []byte
+		if changedAfter {
+			accountData, err = state.GetAsOf(w.tx, false, address[:], to+1)
+		} else {
+			accountData, err = w.tx.GetOne(dbutils.PlainStateBucket, address[:])
+		}
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return err
 		}
 
-		pos += decodeLength + 1
+		if err = w.resolve(address, w.lastChanged[address], accountData); err != nil {
+			return err
+		}
 	}
 
-	decodeLength := int(enc[pos])
+	return w.flush(to + 1)
+}
+
+// calculateDeltas returns the supply changes of the blocks `from`...`to` (see forEachDelta).
+func calculateDeltas(db ethdb.Getter, from, to uint64, watchlist Watchlist) ([]supplyDelta, error) {
+	deltas := make([]supplyDelta, 0, to-from+1)
 
-	if len(enc) < pos+decodeLength+1 {
-		return fmt.Errorf(
-			"malformed CBOR for Account.Nonce: %s, Length %d",
-			enc[pos+1:], decodeLength)
+	err := forEachDelta(db, from, to, watchlist, func(_ uint64, delta *supplyDelta) error {
+		deltas = append(deltas, *delta)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	to.SetBytes(enc[pos+1 : pos+decodeLength+1])
-	return nil
+	return deltas, nil
 }
@@ -0,0 +1,270 @@
+package supply
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// newTestDB creates an in-memory DB with the supply buckets.
+func newTestDB(tb testing.TB) *ethdb.ObjectDatabase {
+	kv := ethdb.NewLMDB().InMem().WithBucketsConfig(func(dbutils.BucketsCfg) dbutils.BucketsCfg {
+		// the same as `node.Params.CustomBuckets` does when running the node
+		buckets := dbutils.DefaultBuckets()
+		for name, cfg := range Buckets {
+			buckets[name] = cfg
+		}
+		return buckets
+	}).MustOpen()
+
+	db := ethdb.NewObjectDatabase(kv)
+	tb.Cleanup(db.Close)
+	return db
+}
+
+// newTestChain creates a DB with the plain state, changesets and history of `blocks` blocks.
+// Every block changes `changesPerBlock` random accounts of `accountsCount`, some of them are deleted.
+func newTestChain(tb testing.TB, blocks, changesPerBlock, accountsCount int) *ethdb.ObjectDatabase {
+	db := newTestDB(tb)
+
+	rnd := rand.New(rand.NewSource(1))
+
+	accountsState := make([]accounts.Account, accountsCount)
+	addresses := make([]common.Address, accountsCount)
+	for i := range addresses {
+		binary.BigEndian.PutUint64(addresses[i][12:], rnd.Uint64())
+	}
+
+	for blockNumber := 1; blockNumber <= blocks; blockNumber++ {
+		w := state.NewPlainStateWriter(db, db, uint64(blockNumber))
+
+		changed := make(map[int]struct{}, changesPerBlock)
+		for len(changed) < changesPerBlock {
+			changed[rnd.Intn(accountsCount)] = struct{}{}
+		}
+
+		for i := range changed {
+			original := accountsState[i]
+
+			if original.Initialised && rnd.Intn(10) == 0 {
+				if err := w.DeleteAccount(context.Background(), addresses[i], &original); err != nil {
+					tb.Fatal(err)
+				}
+				accountsState[i] = accounts.Account{}
+				continue
+			}
+
+			if !original.Initialised {
+				accountsState[i] = accounts.NewAccount()
+				accountsState[i].Initialised = true
+
+				// some of the accounts are contracts
+				if rnd.Intn(5) == 0 {
+					accountsState[i].Incarnation = 1
+					binary.BigEndian.PutUint64(accountsState[i].CodeHash[:], rnd.Uint64())
+				}
+			}
+			accountsState[i].Nonce++
+			accountsState[i].Balance.SetUint64(rnd.Uint64() >> uint(rnd.Intn(64)))
+
+			if err := w.UpdateAccountData(context.Background(), addresses[i], &original, &accountsState[i]); err != nil {
+				tb.Fatal(err)
+			}
+		}
+
+		if err := w.WriteChangeSets(); err != nil {
+			tb.Fatal(err)
+		}
+		if err := w.WriteHistory(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return db
+}
+
+// calculateDeltasAsOf is the straightforward way of calculating the supply changes:
+// it looks up the balance after the block in the history for every account in every changeset.
+func calculateDeltasAsOf(db *ethdb.ObjectDatabase, from, to uint64) ([]supplyDelta, error) {
+	tx, err := db.RwKV().Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deltas := make([]supplyDelta, to-from+1)
+	acc := &account{}
+
+	for blockNumber := from; blockNumber <= to; blockNumber++ {
+		delta := &deltas[blockNumber-from]
+
+		err = changeset.Walk(db, dbutils.PlainAccountChangeSetBucket, dbutils.EncodeBlockNumber(blockNumber), 8*8, func(_ uint64, k, accountDataBeforeBlock []byte) (bool, error) {
+			if err := decodeAccount(accountDataBeforeBlock, acc); err != nil {
+				return false, err
+			}
+			delta.remove(&acc.balance, acc.hasCode(), false)
+
+			accountDataAfterBlock, err := state.GetAsOf(tx, false, k, blockNumber+1)
+			if err != nil && err != ethdb.ErrKeyNotFound {
+				return false, err
+			}
+			if err = decodeAccount(accountDataAfterBlock, acc); err != nil {
+				return false, err
+			}
+			delta.add(&acc.balance, acc.hasCode(), false)
+
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return deltas, nil
+}
+
+func TestCalculateDeltas(t *testing.T) {
+	db := newTestChain(t, 300, 20, 500)
+
+	for _, tc := range []struct{ from, to uint64 }{
+		{1, 300},
+		{1, 1},
+		{50, 120},
+		{300, 300},
+	} {
+		expected, err := calculateDeltasAsOf(db, tc.from, tc.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deltas, err := calculateDeltas(db, tc.from, tc.to, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range expected {
+			if !deltas[i].increase.Eq(&expected[i].increase) || !deltas[i].decrease.Eq(&expected[i].decrease) ||
+				!deltas[i].contractIncrease.Eq(&expected[i].contractIncrease) || !deltas[i].contractDecrease.Eq(&expected[i].contractDecrease) {
+				t.Errorf("range %d...%d, block %d: +%d -%d, expected +%d -%d", tc.from, tc.to, tc.from+uint64(i),
+					&deltas[i].increase, &deltas[i].decrease, &expected[i].increase, &expected[i].decrease)
+			}
+			if deltas[i].holders != expected[i].holders || deltas[i].histogram != expected[i].histogram {
+				t.Errorf("range %d...%d, block %d: %+d holders %v, expected %+d %v", tc.from, tc.to, tc.from+uint64(i),
+					deltas[i].holders, deltas[i].histogram, expected[i].holders, expected[i].histogram)
+			}
+		}
+	}
+}
+
+func TestForEachDelta(t *testing.T) {
+	db := newTestChain(t, 300, 20, 500)
+
+	expected, err := calculateDeltasAsOf(db, 1, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the batches don't divide the range evenly
+	defer func(size uint64) { deltasBatchSize = size }(deltasBatchSize)
+	deltasBatchSize = 7
+
+	next := uint64(1)
+	err = forEachDelta(db, 1, 300, nil, func(blockNumber uint64, delta *supplyDelta) error {
+		if blockNumber != next {
+			t.Fatalf("expected the block %d, got %d", next, blockNumber)
+		}
+		if *delta != expected[blockNumber-1] {
+			t.Errorf("block %d: %+v, expected %+v", blockNumber, delta, &expected[blockNumber-1])
+		}
+		next++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 301 {
+		t.Errorf("expected the blocks up to 300, got up to %d", next-1)
+	}
+}
+
+func BenchmarkCalculateDeltas(b *testing.B) {
+	db := newTestChain(b, 1000, 200, 20_000)
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := calculateDeltas(db, 1, 1000, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("history", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := calculateDeltasAsOf(db, 1, 1000); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestTotals checks that the forward and the backward calculations agree on all the totals.
+func TestTotals(t *testing.T) {
+	db := newTestChain(t, 300, 20, 500)
+
+	// every 10th account is locked
+	watchlist := make(Watchlist)
+	i := 0
+	err := db.Walk(dbutils.PlainStateBucket, nil, 0, func(k, _ []byte) (bool, error) {
+		if isAccount(k) && i%10 == 0 {
+			watchlist[common.BytesToAddress(k)] = struct{}{}
+		}
+		i++
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := BackwardConfig{Config: Config{Watchlist: watchlist}}
+
+	backward := make([]Totals, 301)
+	err = calculateBackward(db, 1, 300, cfg, func(blockNumber uint64, totals *Totals) error {
+		backward[blockNumber] = *totals
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	totals := backward[1]
+	err = calculateForward(db, nil, 2, 300, watchlist, &totals, func(blockNumber uint64, forward *Totals) error {
+		if *forward != backward[blockNumber] {
+			t.Errorf("block %d: forward %+v, backward %+v", blockNumber, forward, &backward[blockNumber])
+		}
+
+		holders := uint64(0)
+		for _, count := range forward.Histogram {
+			holders += count
+		}
+		if holders != forward.Holders {
+			t.Errorf("block %d: %d holders in the histogram, expected %d", blockNumber, holders, forward.Holders)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := &backward[300]
+	if last.Holders == 0 || last.ContractSupply.IsZero() || last.LockedSupply.IsZero() {
+		t.Errorf("the test chain doesn't cover all the totals: %+v", last)
+	}
+}
@@ -0,0 +1,323 @@
+package supply
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+const CheckpointBucketName = "org.ffconsulting.tg.db.ETH_SUPPLY_CHECKPOINT"
+
+var backwardCheckpointKey = []byte("backward")
+
+// BackwardCheckpoint is the saved progress of an interrupted backward calculation.
+// The checkpoint record is stored in the same DB (and in the same transaction) as the supply values,
+// so it never points to the blocks that aren't stored.
+// The balances are too big for a single DB value, so they are stored in a separate snapshot file.
+type BackwardCheckpoint struct {
+	// From and To are the block range of the calculation.
+	From, To uint64
+	// BlockNumber is the last block the supply is calculated and stored for.
+	BlockNumber uint64
+	// TotalSupply is the supply at BlockNumber.
+	TotalSupply uint256.Int
+	// Snapshot is the path to the file with all the account balances at BlockNumber.
+	Snapshot string
+}
+
+// ReadBackwardCheckpoint returns the saved checkpoint or nil if there isn't one.
+func ReadBackwardCheckpoint(db ethdb.Getter) (*BackwardCheckpoint, error) {
+	enc, err := db.Get(CheckpointBucketName, backwardCheckpointKey)
+	if err == ethdb.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decodeBackwardCheckpoint(enc)
+}
+
+// LoadBackwardCheckpoint returns the checkpoint that the calculation can be resumed from
+// when the current state is at the block `currentStateAt`.
+// If the checkpoint can't be used anymore (the chain was unwound below it or the snapshot file is lost)
+// it is removed and nil is returned.
+func LoadBackwardCheckpoint(db ethdb.Database, currentStateAt uint64) (*BackwardCheckpoint, error) {
+	checkpoint, err := ReadBackwardCheckpoint(db)
+	if err != nil || checkpoint == nil {
+		return nil, err
+	}
+
+	if checkpoint.BlockNumber > currentStateAt {
+		log.Warn("Discarding the supply checkpoint, the chain was unwound below it", "block", checkpoint.BlockNumber, "currentStateAt", currentStateAt)
+		return nil, DeleteBackwardCheckpoint(db)
+	}
+
+	if _, err = os.Stat(checkpoint.Snapshot); err != nil {
+		log.Warn("Discarding the supply checkpoint, can't find the balances snapshot", "block", checkpoint.BlockNumber, "err", err)
+		return nil, DeleteBackwardCheckpoint(db)
+	}
+
+	return checkpoint, nil
+}
+
+// DeleteBackwardCheckpoint removes the checkpoint together with its snapshot file.
+func DeleteBackwardCheckpoint(db ethdb.Database) error {
+	checkpoint, err := ReadBackwardCheckpoint(db)
+	if err != nil || checkpoint == nil {
+		return err
+	}
+
+	if err = os.Remove(checkpoint.Snapshot); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return db.Delete(CheckpointBucketName, backwardCheckpointKey, nil)
+}
+
+// UnwindBackwardCheckpoint makes the checkpoint consistent with the chain unwound to the block `unwindPoint`.
+// The supply values after the unwind point are removed, so they have to be calculated again after resuming.
+func UnwindBackwardCheckpoint(db ethdb.Database, unwindPoint uint64) error {
+	checkpoint, err := ReadBackwardCheckpoint(db)
+	if err != nil || checkpoint == nil || checkpoint.To <= unwindPoint {
+		return err
+	}
+
+	if checkpoint.BlockNumber > unwindPoint {
+		return DeleteBackwardCheckpoint(db)
+	}
+
+	checkpoint.To = unwindPoint
+	return db.Put(CheckpointBucketName, backwardCheckpointKey, encodeBackwardCheckpoint(checkpoint))
+}
+
+// backwardCheckpointer stores the supply values of the backward calculation
+// and saves a checkpoint every `cfg.CheckpointInterval` blocks.
+type backwardCheckpointer struct {
+	db       ethdb.Database
+	cfg      BackwardConfig
+	from, to uint64
+	balances *balanceStore
+	last     *BackwardCheckpoint
+}
+
+func (c *backwardCheckpointer) onBlock(blockNumber uint64, totals *Totals) error {
+	// the calculation starts at `c.to`, that's the block the next calculation continues from
+	withHistogram := blockNumber == c.to || storesHistogram(blockNumber, c.cfg.HistogramInterval)
+	if err := setTotalsForBlock(c.db, blockNumber, totals, withHistogram); err != nil {
+		return err
+	}
+
+	if c.storesRichList(blockNumber) {
+		list, err := topBalances(c.balances.forEach, c.cfg.RichListSize)
+		if err != nil {
+			return err
+		}
+
+		if err = SetRichListForBlock(c.db, blockNumber, list); err != nil {
+			return err
+		}
+	}
+
+	if c.cfg.ConcentrationInterval > 0 && (blockNumber == c.to || blockNumber%c.cfg.ConcentrationInterval == 0) {
+		concentration, err := calculateConcentration(c.balances.forEach)
+		if err != nil {
+			return err
+		}
+
+		if err = SetConcentrationForBlock(c.db, blockNumber, concentration); err != nil {
+			return err
+		}
+	}
+
+	if c.cfg.CheckpointInterval == 0 || c.cfg.TmpDir == "" || blockNumber == c.from {
+		return nil
+	}
+
+	if c.last != nil && c.last.BlockNumber == blockNumber {
+		// we have just resumed from this checkpoint
+		return nil
+	}
+
+	// right after reading the current state is the most valuable checkpoint, it takes hours to get there
+	if blockNumber != c.to && blockNumber%c.cfg.CheckpointInterval != 0 {
+		return nil
+	}
+
+	checkpoint := &BackwardCheckpoint{
+		From:        c.from,
+		To:          c.to,
+		BlockNumber: blockNumber,
+		Snapshot:    filepath.Join(c.cfg.TmpDir, fmt.Sprintf("supply-balances-%d.snapshot", blockNumber)),
+	}
+	checkpoint.TotalSupply.Set(&totals.Supply)
+
+	log.Info("Saving the supply checkpoint", "block", blockNumber, "accounts", c.balances.len())
+
+	// the snapshot has to be on disk before the record that points to it
+	if err := writeBalancesSnapshot(checkpoint.Snapshot, c.balances); err != nil {
+		return err
+	}
+
+	if err := c.db.Put(CheckpointBucketName, backwardCheckpointKey, encodeBackwardCheckpoint(checkpoint)); err != nil {
+		return err
+	}
+
+	// the old snapshot is only removed when the new checkpoint can't be rolled back
+	if c.cfg.Commit != nil {
+		if err := c.cfg.Commit(); err != nil {
+			return err
+		}
+	}
+
+	if c.last != nil && c.last.Snapshot != checkpoint.Snapshot {
+		if err := os.Remove(c.last.Snapshot); err != nil && !os.IsNotExist(err) {
+			log.Warn("Can't remove the old balances snapshot", "path", c.last.Snapshot, "err", err)
+		}
+	}
+
+	c.last = checkpoint
+	return nil
+}
+
+// storesRichList returns true if the rich list is stored for the block.
+// The rich lists at the ends of the range make every block in it answerable by replaying forward.
+func (c *backwardCheckpointer) storesRichList(blockNumber uint64) bool {
+	if c.cfg.RichListInterval == 0 || c.cfg.RichListSize <= 0 {
+		return false
+	}
+	return blockNumber == c.from || blockNumber == c.to || blockNumber%c.cfg.RichListInterval == 0
+}
+
+// from | to | block number | supply length | supply | snapshot path
+func encodeBackwardCheckpoint(checkpoint *BackwardCheckpoint) []byte {
+	supplyBytes := checkpoint.TotalSupply.Bytes()
+
+	buffer := make([]byte, 3*8, 3*8+1+len(supplyBytes)+len(checkpoint.Snapshot))
+	binary.BigEndian.PutUint64(buffer[0:], checkpoint.From)
+	binary.BigEndian.PutUint64(buffer[8:], checkpoint.To)
+	binary.BigEndian.PutUint64(buffer[16:], checkpoint.BlockNumber)
+	buffer = append(buffer, byte(len(supplyBytes)))
+	buffer = append(buffer, supplyBytes...)
+	buffer = append(buffer, checkpoint.Snapshot...)
+	return buffer
+}
+
+func decodeBackwardCheckpoint(enc []byte) (*BackwardCheckpoint, error) {
+	if len(enc) < 3*8+1 {
+		return nil, fmt.Errorf("malformed supply checkpoint: %x", enc)
+	}
+
+	supplyLength := int(enc[3*8])
+	if supplyLength > 32 || len(enc) < 3*8+1+supplyLength {
+		return nil, fmt.Errorf("malformed supply checkpoint: %x", enc)
+	}
+
+	checkpoint := &BackwardCheckpoint{
+		From:        binary.BigEndian.Uint64(enc[0:]),
+		To:          binary.BigEndian.Uint64(enc[8:]),
+		BlockNumber: binary.BigEndian.Uint64(enc[16:]),
+		Snapshot:    string(enc[3*8+1+supplyLength:]),
+	}
+	checkpoint.TotalSupply.SetBytes(enc[3*8+1 : 3*8+1+supplyLength])
+
+	return checkpoint, nil
+}
+
+// snapshotContractFlag is set in the balance length of the accounts with code
+const snapshotContractFlag = 0x80
+
+// the snapshot is a sequence of (address | flags and balance length | balance) records
+func writeBalancesSnapshot(path string, balances *balanceStore) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriterSize(f, 1024*1024)
+
+	err = balances.forEach(func(address common.Address, entry *balanceEntry) error {
+		balanceBytes := entry.balance.Bytes()
+
+		header := byte(len(balanceBytes))
+		if entry.contract {
+			header |= snapshotContractFlag
+		}
+
+		if _, err := w.Write(address[:]); err != nil {
+			return err
+		}
+		if err := w.WriteByte(header); err != nil {
+			return err
+		}
+		_, err := w.Write(balanceBytes)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	// make sure the snapshot survives a crash before the checkpoint record is written
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// readBalancesSnapshot reads the snapshot into the empty store and adds the balances to the empty totals.
+func readBalancesSnapshot(path string, watchlist Watchlist, balances *balanceStore, totals *Totals) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1024*1024)
+
+	var address common.Address
+	var balanceBytes [32]byte
+
+	for {
+		if _, err = io.ReadFull(r, address[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("malformed balances snapshot %s: %w", path, err)
+		}
+
+		header, err := r.ReadByte()
+		length := header &^ snapshotContractFlag
+		if err != nil || length > 32 {
+			return fmt.Errorf("malformed balances snapshot %s: balance of %x", path, address)
+		}
+
+		if _, err = io.ReadFull(r, balanceBytes[:length]); err != nil {
+			return fmt.Errorf("malformed balances snapshot %s: %w", path, err)
+		}
+
+		entry := &balanceEntry{contract: header&snapshotContractFlag != 0}
+		entry.balance.SetBytes(balanceBytes[:length])
+		totals.add(&entry.balance, entry.contract, watchlist.Contains(address))
+
+		// every address is in the snapshot only once, so we don't have to look it up first
+		if err = balances.put(address, entry); err != nil {
+			return err
+		}
+	}
+}
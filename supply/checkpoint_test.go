@@ -0,0 +1,154 @@
+package supply
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// interruptBackward starts the backward calculation from genesis to the head and stops it
+// right after the checkpoint at the block `at` is saved, like the node does when it is stopped.
+func (h *syncHarness) interruptBackward(at uint64) *BackwardCheckpoint {
+	cfg := h.cfg
+	cfg.Commit = func() error {
+		checkpoint, err := ReadBackwardCheckpoint(h.tx)
+		if err != nil || checkpoint.BlockNumber == at {
+			return errInterrupted
+		}
+		return nil
+	}
+
+	if err := CalculateBackward(h.tx, 0, h.head(), cfg); !errors.Is(err, errInterrupted) {
+		h.t.Fatalf("expected the calculation to be interrupted, got %v", err)
+	}
+
+	checkpoint, err := LoadBackwardCheckpoint(h.tx, h.head())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if checkpoint == nil || checkpoint.BlockNumber != at || checkpoint.From != 0 || checkpoint.To != h.head() {
+		h.t.Fatalf("expected the checkpoint at the block %d, got %+v", at, checkpoint)
+	}
+	return checkpoint
+}
+
+// resume continues the interrupted calculation up to the head.
+func (h *syncHarness) resume(checkpoint *BackwardCheckpoint) {
+	if err := ResumeBackward(h.tx, checkpoint, h.head(), h.cfg); err != nil {
+		h.t.Fatal(err)
+	}
+	if err := stages.SaveStageProgress(h.tx, StageID, h.head()); err != nil {
+		h.t.Fatal(err)
+	}
+
+	if checkpoint, err := ReadBackwardCheckpoint(h.tx); err != nil || checkpoint != nil {
+		h.t.Errorf("expected the checkpoint to be removed, got %+v (%v)", checkpoint, err)
+	}
+}
+
+func TestResumeBackward(t *testing.T) {
+	h := newSyncHarness(t, Config{})
+	h.cfg.CheckpointInterval = 10
+	h.cfg.TmpDir = t.TempDir()
+	h.execute(40)
+
+	checkpoint := h.interruptBackward(20)
+
+	// the chain moves on while the node is stopped, the blocks before the checkpoint
+	// can only be calculated from its balances now
+	h.execute(5)
+	h.resume(checkpoint)
+	h.check()
+
+	if _, err := os.Stat(checkpoint.Snapshot); !os.IsNotExist(err) {
+		t.Errorf("expected the snapshot to be removed, got %v", err)
+	}
+}
+
+func TestResumeBackwardBadSnapshot(t *testing.T) {
+	for name, damage := range map[string]func(path string) error{
+		"empty": func(path string) error {
+			return ioutil.WriteFile(path, nil, 0600)
+		},
+		"truncated": func(path string) error {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return os.Truncate(path, info.Size()-1)
+		},
+		"missing": os.Remove,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newSyncHarness(t, Config{})
+			h.cfg.CheckpointInterval = 10
+			h.cfg.TmpDir = t.TempDir()
+			h.execute(30)
+
+			checkpoint := h.interruptBackward(20)
+			if err := damage(checkpoint.Snapshot); err != nil {
+				t.Fatal(err)
+			}
+
+			// calculated again from the current state
+			h.resume(checkpoint)
+			h.check()
+		})
+	}
+}
+
+func TestLoadBackwardCheckpoint(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		currentStateAt uint64
+		snapshot       bool
+		discarded      bool
+	}{
+		{name: "valid", currentStateAt: 30, snapshot: true},
+		{name: "state moved on", currentStateAt: 35, snapshot: true},
+		{name: "unwound below it", currentStateAt: 15, snapshot: true, discarded: true},
+		{name: "missing snapshot", currentStateAt: 30, discarded: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newSyncHarness(t, Config{})
+
+			snapshot := filepath.Join(t.TempDir(), "supply-balances-20.snapshot")
+			if tt.snapshot {
+				if err := ioutil.WriteFile(snapshot, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			saved := &BackwardCheckpoint{From: 0, To: 30, BlockNumber: 20, Snapshot: snapshot}
+			if err := h.tx.Put(CheckpointBucketName, backwardCheckpointKey, encodeBackwardCheckpoint(saved)); err != nil {
+				t.Fatal(err)
+			}
+
+			checkpoint, err := LoadBackwardCheckpoint(h.tx, tt.currentStateAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.discarded != (checkpoint == nil) {
+				t.Fatalf("expected discarded %t, got the checkpoint %+v", tt.discarded, checkpoint)
+			}
+
+			stored, err := ReadBackwardCheckpoint(h.tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.discarded != (stored == nil) {
+				t.Errorf("expected the record removed %t, got %+v", tt.discarded, stored)
+			}
+
+			if _, err = os.Stat(snapshot); tt.discarded != os.IsNotExist(err) {
+				t.Errorf("expected the snapshot removed %t, got %v", tt.discarded, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package supply
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const ConcentrationBucketName = "org.ffconsulting.tg.db.ETH_CONCENTRATION"
+
+// Concentration is how unevenly ETH is distributed between the holders (the accounts with non-zero balance).
+type Concentration struct {
+	Holders uint64
+	// Gini is the Gini coefficient of the balances: 0 if everybody has the same balance, close to 1 if one holder has everything.
+	Gini float64
+	// Top01Share, Top1Share and Top10Share are the shares of the supply that the top 0.1%, 1% and 10%
+	// of the holders have (from 0 to 1). The top always contains at least one holder.
+	Top01Share float64
+	Top1Share  float64
+	Top10Share float64
+	// Nakamoto is the smallest number of holders that together have more than a half of the supply.
+	Nakamoto uint64
+}
+
+// calculateConcentration calculates the concentration of the balances.
+// It sorts all of the balances, so it needs 8 bytes of memory per holder.
+// The balances are converted to float64, that is precise enough for the ratios.
+func calculateConcentration(balances forEachBalance) (*Concentration, error) {
+	var values []float64
+
+	err := balances(func(_ common.Address, entry *balanceEntry) error {
+		if !entry.balance.IsZero() {
+			values = append(values, toFloat64(&entry.balance))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return concentrationOf(values), nil
+}
+
+// concentrationOf calculates the concentration of the balances, it sorts `values` in place.
+func concentrationOf(values []float64) *Concentration {
+	result := &Concentration{Holders: uint64(len(values))}
+	if len(values) == 0 {
+		return result
+	}
+
+	sort.Float64s(values)
+
+	n := float64(len(values))
+
+	// G = sum((2i - n - 1) * x_i) / (n * sum(x_i)) for the ascending balances, i = 1...n
+	var total, weighted float64
+	for i, value := range values {
+		total += value
+		weighted += (2*float64(i+1) - n - 1) * value
+	}
+	result.Gini = weighted / (n * total)
+
+	// the top shares and the Nakamoto coefficient go from the largest balance
+	topCounts := []int{topCount(len(values), 0.001), topCount(len(values), 0.01), topCount(len(values), 0.1)}
+	topShares := []*float64{&result.Top01Share, &result.Top1Share, &result.Top10Share}
+
+	var top float64
+	for i := 0; i < len(values); i++ {
+		top += values[len(values)-1-i]
+
+		for j, count := range topCounts {
+			if i+1 == count {
+				*topShares[j] = top / total
+			}
+		}
+
+		if result.Nakamoto == 0 && top > total/2 {
+			result.Nakamoto = uint64(i + 1)
+		}
+	}
+
+	return result
+}
+
+// topCount is the number of holders in the top `share` of them, at least 1.
+func topCount(holders int, share float64) int {
+	count := int(math.Ceil(float64(holders) * share))
+	if count < 1 {
+		return 1
+	}
+	return count
+}
+
+func toFloat64(value *uint256.Int) float64 {
+	return float64(value[3])*0x1p192 + float64(value[2])*0x1p128 + float64(value[1])*0x1p64 + float64(value[0])
+}
+
+// holders | gini | top 0.1% | top 1% | top 10% | nakamoto
+func SetConcentrationForBlock(db ethdb.Putter, blockNumber uint64, concentration *Concentration) error {
+	value := make([]byte, 6*8)
+	binary.BigEndian.PutUint64(value[0:], concentration.Holders)
+	binary.BigEndian.PutUint64(value[8:], math.Float64bits(concentration.Gini))
+	binary.BigEndian.PutUint64(value[16:], math.Float64bits(concentration.Top01Share))
+	binary.BigEndian.PutUint64(value[24:], math.Float64bits(concentration.Top1Share))
+	binary.BigEndian.PutUint64(value[32:], math.Float64bits(concentration.Top10Share))
+	binary.BigEndian.PutUint64(value[40:], concentration.Nakamoto)
+	return db.Put(ConcentrationBucketName, keyFromBlockNumber(blockNumber), value)
+}
+
+func DeleteConcentrationForBlock(db ethdb.Deleter, blockNumber uint64) error {
+	return db.Delete(ConcentrationBucketName, keyFromBlockNumber(blockNumber), nil)
+}
+
+// FindConcentration returns the concentration of the closest block at or before `blockNumber` that has it stored.
+// It returns ethdb.ErrKeyNotFound if there is no such block.
+func FindConcentration(tx ethdb.Tx, blockNumber uint64) (uint64, *Concentration, error) {
+	k, v, err := seekAtOrBefore(tx, ConcentrationBucketName, blockNumber)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(v) != 6*8 {
+		return 0, nil, fmt.Errorf("malformed ETH concentration: %x", v)
+	}
+
+	return binary.BigEndian.Uint64(k), &Concentration{
+		Holders:    binary.BigEndian.Uint64(v[0:]),
+		Gini:       math.Float64frombits(binary.BigEndian.Uint64(v[8:])),
+		Top01Share: math.Float64frombits(binary.BigEndian.Uint64(v[16:])),
+		Top1Share:  math.Float64frombits(binary.BigEndian.Uint64(v[24:])),
+		Top10Share: math.Float64frombits(binary.BigEndian.Uint64(v[32:])),
+		Nakamoto:   binary.BigEndian.Uint64(v[40:]),
+	}, nil
+}
@@ -0,0 +1,72 @@
+package supply
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestConcentrationOf(t *testing.T) {
+	for _, tc := range []struct {
+		values   []float64
+		expected Concentration
+	}{
+		{nil, Concentration{}},
+		{[]float64{5, 5, 5, 5}, Concentration{Holders: 4, Gini: 0, Top01Share: 0.25, Top1Share: 0.25, Top10Share: 0.25, Nakamoto: 3}},
+		{[]float64{3, 1, 4, 2}, Concentration{Holders: 4, Gini: 0.25, Top01Share: 0.4, Top1Share: 0.4, Top10Share: 0.4, Nakamoto: 2}},
+		{[]float64{1, 1, 1, 1, 1, 1, 1, 1, 1, 91}, Concentration{Holders: 10, Gini: 0.81, Top01Share: 0.91, Top1Share: 0.91, Top10Share: 0.91, Nakamoto: 1}},
+	} {
+		c := concentrationOf(tc.values)
+
+		if c.Holders != tc.expected.Holders || c.Nakamoto != tc.expected.Nakamoto ||
+			!almostEqual(c.Gini, tc.expected.Gini) || !almostEqual(c.Top01Share, tc.expected.Top01Share) ||
+			!almostEqual(c.Top1Share, tc.expected.Top1Share) || !almostEqual(c.Top10Share, tc.expected.Top10Share) {
+			t.Errorf("%v: %+v, expected %+v", tc.values, c, tc.expected)
+		}
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// TestConcentrationAtTip syncs forward past an interval and reads the concentration stored at the tip.
+func TestConcentrationAtTip(t *testing.T) {
+	h := newSyncHarness(t, Config{ConcentrationInterval: 10})
+	tx := h.tx.(ethdb.HasTx).Tx()
+
+	expectedAt := func(blockNumber uint64) *Concentration {
+		var values []float64
+		for i := range h.states[blockNumber] {
+			if balance := &h.states[blockNumber][i].Balance; !balance.IsZero() {
+				values = append(values, toFloat64(balance))
+			}
+		}
+		return concentrationOf(values)
+	}
+
+	// the first sync stores it, the second one passes the block 10, the third one doesn't pass the block 20
+	for _, tc := range []struct {
+		blocks   int
+		storedAt uint64
+	}{
+		{8, 8},
+		{4, 12},
+		{5, 12},
+	} {
+		h.execute(tc.blocks)
+		h.sync(StrategyForward)
+
+		storedAt, concentration, err := FindConcentration(tx, h.head())
+		if err != nil {
+			t.Fatalf("block %d: %v", h.head(), err)
+		}
+		if storedAt != tc.storedAt {
+			t.Errorf("block %d: expected the concentration stored at the block %d, got %d", h.head(), tc.storedAt, storedAt)
+		}
+		if expected := expectedAt(storedAt); *concentration != *expected {
+			t.Errorf("block %d: concentration %+v, expected %+v", storedAt, concentration, expected)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package supply
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	GenesisFlag = cli.StringFlag{
+		Name:  "supply.genesis",
+		Usage: "Path to the genesis JSON file to calculate the supply at genesis from (for private chains and devnets). By default the genesis is detected from the datadir",
+	}
+
+	WorkersFlag = cli.IntFlag{
+		Name:  "supply.workers",
+		Usage: "Number of goroutines reading the current state in parallel when calculating the supply backward",
+		Value: runtime.NumCPU(),
+	}
+
+	CheckpointIntervalFlag = cli.Uint64Flag{
+		Name:  "supply.checkpoint.interval",
+		Usage: "How often (in blocks) the backward calculation saves its progress to be resumed after a restart, 0 disables checkpoints",
+		Value: 500_000,
+	}
+
+	MemoryBudgetFlag = cli.IntFlag{
+		Name:  "supply.memory.budget",
+		Usage: "Max memory (in MB) for the account balances of the backward calculation, the balances that don't fit are spilled to a temporary DB on disk. 0 means no limit",
+	}
+
+	StrategyFlag = cli.StringFlag{
+		Name:  "supply.strategy",
+		Usage: "How to calculate the supply: auto (pick the fastest one based on the measured speed), forward or backward",
+		Value: string(StrategyAuto),
+	}
+
+	HistogramIntervalFlag = cli.Uint64Flag{
+		Name:  "supply.histogram.interval",
+		Usage: "How often (in blocks) the balance histogram is stored, 1 stores it for every block",
+		Value: 1_000,
+	}
+
+	RichListIntervalFlag = cli.Uint64Flag{
+		Name:  "supply.richlist.interval",
+		Usage: "How often (in blocks) the accounts with the largest balances are stored, 0 disables the rich list",
+		Value: 100_000,
+	}
+
+	RichListSizeFlag = cli.IntFlag{
+		Name:  "supply.richlist.size",
+		Usage: "Number of the accounts with the largest balances in the stored rich lists",
+		Value: 1_000,
+	}
+
+	ConcentrationIntervalFlag = cli.Uint64Flag{
+		Name:  "supply.concentration.interval",
+		Usage: "How often (in blocks) the concentration of the balances (Gini coefficient, top holders shares) is stored, 0 disables it",
+		Value: 100_000,
+	}
+
+	WatchlistFlag = cli.StringFlag{
+		Name:  "supply.watchlist",
+		Usage: "Path to the file with the addresses (one per line) which balances aren't circulating (burn addresses, deposit contracts, etc)",
+	}
+
+	SupplyIntervalFlag = cli.Uint64Flag{
+		Name:  "supply.interval",
+		Usage: "How often (in blocks) the supply is stored, the supply of the other blocks is calculated on request from the closest stored one. 1 stores it for every block",
+		Value: 1,
+	}
+
+	SupplyRetentionFlag = cli.Uint64Flag{
+		Name:  "supply.retention",
+		Usage: "Number of the latest blocks that have the supply stored for every block when --supply.interval is more than 1",
+		Value: 10_000,
+	}
+
+	BatchSizeFlag = cli.Uint64Flag{
+		Name:  "supply.batch.size",
+		Usage: "How many blocks the stage calculates forward between the commits when it runs in its own transaction (the progress of the batch is lost on a crash), 0 commits once at the end",
+		Value: 100_000,
+	}
+
+	// Flags contains all the command-line flags that the supply stage supports.
+	Flags = []cli.Flag{
+		GenesisFlag,
+		WorkersFlag,
+		CheckpointIntervalFlag,
+		MemoryBudgetFlag,
+		StrategyFlag,
+		HistogramIntervalFlag,
+		RichListIntervalFlag,
+		RichListSizeFlag,
+		ConcentrationIntervalFlag,
+		WatchlistFlag,
+		SupplyIntervalFlag,
+		SupplyRetentionFlag,
+		BatchSizeFlag,
+	}
+)
+
+// BackwardConfigFromContext creates the backward calculation settings from the command-line flags.
+// * db - the database to open additional read transactions in.
+// * tmpDir - the directory for the checkpoint snapshots and the spilled balances, checkpoints are disabled if it is empty.
+func BackwardConfigFromContext(ctx *cli.Context, db ethdb.Database, tmpDir string) (BackwardConfig, error) {
+	config, err := ConfigFromContext(ctx)
+	if err != nil {
+		return BackwardConfig{}, err
+	}
+
+	cfg := BackwardConfig{
+		Config:             config,
+		Workers:            ctx.Int(WorkersFlag.Name),
+		CheckpointInterval: ctx.Uint64(CheckpointIntervalFlag.Name),
+		MemoryBudget:       ctx.Int(MemoryBudgetFlag.Name),
+		TmpDir:             tmpDir,
+	}
+
+	if hasKV, ok := db.(ethdb.HasRwKV); ok {
+		cfg.KV = hasKV.RwKV()
+	}
+
+	return cfg, nil
+}
+
+// ConfigFromContext creates the settings shared by both of the calculations from the command-line flags.
+func ConfigFromContext(ctx *cli.Context) (Config, error) {
+	cfg := Config{
+		HistogramInterval:     ctx.Uint64(HistogramIntervalFlag.Name),
+		SupplyInterval:        ctx.Uint64(SupplyIntervalFlag.Name),
+		SupplyRetention:       ctx.Uint64(SupplyRetentionFlag.Name),
+		BatchSize:             ctx.Uint64(BatchSizeFlag.Name),
+		RichListInterval:      ctx.Uint64(RichListIntervalFlag.Name),
+		RichListSize:          ctx.Int(RichListSizeFlag.Name),
+		ConcentrationInterval: ctx.Uint64(ConcentrationIntervalFlag.Name),
+	}
+
+	if path := ctx.String(WatchlistFlag.Name); path != "" {
+		var err error
+		if cfg.Watchlist, err = ReadWatchlist(path); err != nil {
+			return Config{}, fmt.Errorf("can't read the supply watchlist: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// StrategyFromContext returns the strategy forced with the command-line flag (StrategyAuto by default).
+func StrategyFromContext(ctx *cli.Context) (Strategy, error) {
+	return ParseStrategy(ctx.String(StrategyFlag.Name))
+}
@@ -0,0 +1,110 @@
+package supply
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+
+	"github.com/urfave/cli"
+)
+
+// ReadGenesisFile reads a genesis specification from the JSON file (the same format as `geth init` uses).
+func ReadGenesisFile(path string) (*core.Genesis, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read genesis file: %w", err)
+	}
+	defer file.Close()
+
+	genesis := new(core.Genesis)
+	if err := json.NewDecoder(file).Decode(genesis); err != nil {
+		return nil, fmt.Errorf("invalid genesis file %s: %w", path, err)
+	}
+	return genesis, nil
+}
+
+// GenesisFromContext reads the genesis specification from the file provided by `GenesisFlag`.
+// It returns `nil` if the flag isn't set, so the genesis is detected from the DB.
+func GenesisFromContext(ctx *cli.Context) (*core.Genesis, error) {
+	if genesisFile := ctx.String(GenesisFlag.Name); genesisFile != "" {
+		return ReadGenesisFile(genesisFile)
+	}
+	return nil, nil
+}
+
+// knownGenesis returns the genesis specification of the network the datadir belongs to.
+// It returns `nil` if the network isn't one of the known public networks.
+func knownGenesis(genesisHash common.Hash) *core.Genesis {
+	switch genesisHash {
+	case params.MainnetGenesisHash:
+		return core.DefaultGenesisBlock()
+	case params.RopstenGenesisHash:
+		return core.DefaultRopstenGenesisBlock()
+	case params.RinkebyGenesisHash:
+		return core.DefaultRinkebyGenesisBlock()
+	case params.GoerliGenesisHash:
+		return core.DefaultGoerliGenesisBlock()
+	case params.YoloV3GenesisHash:
+		return core.DefaultYoloV3GenesisBlock()
+	default:
+		return nil
+	}
+}
+
+// calculateAtGenesis calculates the totals at block 0.
+// * genesis - the genesis specification to use, if `nil` it is detected from the genesis hash in the DB.
+//
+// If the network is unknown and no genesis is provided, the genesis allocation is read
+// from the account changes of the block 0 in the DB.
+func calculateAtGenesis(db ethdb.Database, genesis *core.Genesis, watchlist Watchlist, totals *Totals) error {
+	genesisHash, err := rawdb.ReadCanonicalHash(db, 0)
+	if err != nil {
+		return err
+	}
+
+	if genesis != nil {
+		// make sure that the provided genesis belongs to this datadir
+		block, _, err := genesis.ToBlock(false)
+		if err != nil {
+			return err
+		}
+
+		if genesisHash != (common.Hash{}) && block.Hash() != genesisHash {
+			return fmt.Errorf("the provided genesis doesn't match the datadir: genesis hash %x, datadir genesis hash %x", block.Hash(), genesisHash)
+		}
+	} else {
+		genesis = knownGenesis(genesisHash)
+	}
+
+	if genesis == nil {
+		log.Info("Unknown genesis, reading the genesis allocation from the DB", "hash", genesisHash, "flag", GenesisFlag.Name)
+		deltas, err := calculateDeltas(db, 0, 0, watchlist)
+		if err != nil {
+			return err
+		}
+
+		deltas[0].applyTo(totals)
+		return nil
+	}
+
+	for address, account := range genesis.Alloc {
+		balance, overflow := uint256.FromBig(account.Balance)
+		if overflow {
+			panic("overflows should not happen in genesis")
+		}
+		totals.add(balance, len(account.Code) > 0, watchlist.Contains(address))
+		if !balance.IsZero() {
+			totals.Holders++
+		}
+	}
+
+	return nil
+}
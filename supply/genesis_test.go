@@ -0,0 +1,180 @@
+package supply
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+var testGenesis = &core.Genesis{
+	Config:     params.AllEthashProtocolChanges,
+	Difficulty: big.NewInt(1),
+	GasLimit:   8_000_000,
+	Alloc: core.GenesisAlloc{
+		common.Address{1}: {Balance: big.NewInt(1_000)},
+		common.Address{2}: {Balance: big.NewInt(200), Code: []byte{0x60, 0x00}},
+		common.Address{3}: {Balance: big.NewInt(30)},
+		common.Address{4}: {Balance: big.NewInt(0)},
+	},
+}
+
+// expectedGenesisTotals are the totals of testGenesis with the account 3 in the watchlist.
+func expectedGenesisTotals() *Totals {
+	totals := &Totals{Holders: 3}
+	totals.Supply.SetUint64(1_230)
+	totals.ContractSupply.SetUint64(200)
+	totals.LockedSupply.SetUint64(30)
+	totals.Histogram.add(uint256.NewInt().SetUint64(1_000))
+	totals.Histogram.add(uint256.NewInt().SetUint64(200))
+	totals.Histogram.add(uint256.NewInt().SetUint64(30))
+	return totals
+}
+
+func writeGenesisFile(t *testing.T, genesis *core.Genesis) string {
+	enc, err := json.Marshal(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	if err = ioutil.WriteFile(path, enc, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCalculateAtGenesisFile(t *testing.T) {
+	block, _, err := testGenesis.ToBlock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis, err := ReadGenesisFile(writeGenesisFile(t, testGenesis))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watchlist := Watchlist{common.Address{3}: {}}
+
+	for name, tt := range map[string]struct {
+		datadirGenesis common.Hash
+		mismatch       bool
+	}{
+		"matching genesis":     {datadirGenesis: block.Hash()},
+		"mainnet datadir":      {datadirGenesis: params.MainnetGenesisHash, mismatch: true},
+		"another devnet":       {datadirGenesis: common.Hash{1}, mismatch: true},
+		"no genesis in the DB": {datadirGenesis: common.Hash{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t)
+			if tt.datadirGenesis != (common.Hash{}) {
+				if err := rawdb.WriteCanonicalHash(db, tt.datadirGenesis, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			totals := &Totals{}
+			err := calculateAtGenesis(db, genesis, watchlist, totals)
+			if tt.mismatch {
+				if err == nil || !strings.Contains(err.Error(), "doesn't match the datadir") {
+					t.Fatalf("expected the genesis mismatch error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := expectedGenesisTotals(); *totals != *expected {
+				t.Errorf("totals %+v, expected %+v", totals, expected)
+			}
+		})
+	}
+}
+
+func TestCalculateAtKnownGenesis(t *testing.T) {
+	db := newTestDB(t)
+	if err := rawdb.WriteCanonicalHash(db, params.RinkebyGenesisHash, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := uint256.NewInt()
+	for _, account := range core.DefaultRinkebyGenesisBlock().Alloc {
+		balance, _ := uint256.FromBig(account.Balance)
+		expected.Add(expected, balance)
+	}
+
+	totals := &Totals{}
+	if err := calculateAtGenesis(db, nil, nil, totals); err != nil {
+		t.Fatal(err)
+	}
+	if expected.IsZero() || !totals.Supply.Eq(expected) {
+		t.Errorf("supply %d, expected %d", &totals.Supply, expected)
+	}
+}
+
+// TestCalculateAtGenesisChangeset reads the allocation of an unknown network from the changeset of the block 0.
+func TestCalculateAtGenesisChangeset(t *testing.T) {
+	db := newTestDB(t)
+	if err := rawdb.WriteCanonicalHash(db, common.Hash{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the genesis allocation
+	w := state.NewPlainStateWriter(db, db, 0)
+	for address, alloc := range testGenesis.Alloc {
+		account := accounts.NewAccount()
+		account.Initialised = true
+		account.Balance.SetFromBig(alloc.Balance)
+		if len(alloc.Code) > 0 {
+			account.Incarnation = 1
+			account.CodeHash = common.BytesToHash(alloc.Code)
+		}
+		if err := w.UpdateAccountData(context.Background(), address, &accounts.Account{}, &account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteChangeSets(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the balances change later, so the allocation isn't the current state
+	w = state.NewPlainStateWriter(db, db, 1)
+	original := accounts.NewAccount()
+	original.Initialised = true
+	original.Balance.SetUint64(1_000)
+	changed := original
+	changed.Balance.SetUint64(1)
+	if err := w.UpdateAccountData(context.Background(), common.Address{1}, &original, &changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChangeSets(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	totals := &Totals{}
+	if err := calculateAtGenesis(db, nil, Watchlist{common.Address{3}: {}}, totals); err != nil {
+		t.Fatal(err)
+	}
+	if expected := expectedGenesisTotals(); *totals != *expected {
+		t.Errorf("totals %+v, expected %+v", totals, expected)
+	}
+}
@@ -0,0 +1,145 @@
+package supply
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const HistogramBucketName = "org.ffconsulting.tg.db.ETH_BALANCE_HISTOGRAM"
+
+// HistogramBuckets is the number of the balance ranges in the histogram.
+const HistogramBuckets = 8
+
+// HistogramBounds are the lower bounds (in wei, inclusive) of the balance ranges except the first one,
+// the first range is from 1 wei (zero balances aren't counted) to 0.01 ETH.
+var HistogramBounds = [HistogramBuckets - 1]*uint256.Int{
+	uint256.NewInt().SetUint64(1e16), // 0.01 ETH
+	ether(1),
+	ether(10),
+	ether(100),
+	ether(1_000),
+	ether(10_000),
+	ether(100_000),
+}
+
+// HistogramLabels are the human-readable balance ranges of the histogram (in ETH).
+var HistogramLabels = [HistogramBuckets]string{
+	"<0.01", "0.01-1", "1-10", "10-100", "100-1k", "1k-10k", "10k-100k", ">100k",
+}
+
+func ether(amount uint64) *uint256.Int {
+	return uint256.NewInt().Mul(uint256.NewInt().SetUint64(amount), uint256.NewInt().SetUint64(1e18))
+}
+
+// Histogram is the number of accounts in every balance range (see HistogramLabels).
+// The accounts with zero balance aren't counted, so the sum of it is the holder count.
+type Histogram [HistogramBuckets]uint64
+
+func (h *Histogram) add(balance *uint256.Int) {
+	if !balance.IsZero() {
+		h[histogramBucket(balance)]++
+	}
+}
+
+func (h *Histogram) remove(balance *uint256.Int) {
+	if !balance.IsZero() {
+		h[histogramBucket(balance)]--
+	}
+}
+
+// histogramBucket returns the index of the balance range the balance belongs to.
+func histogramBucket(balance *uint256.Int) int {
+	i := 0
+	for i < len(HistogramBounds) && !balance.Lt(HistogramBounds[i]) {
+		i++
+	}
+	return i
+}
+
+// storesHistogram returns true if the histogram is stored for the block when it is stored every `interval` blocks.
+func storesHistogram(blockNumber, interval uint64) bool {
+	return interval <= 1 || blockNumber%interval == 0
+}
+
+func SetHistogramForBlock(db ethdb.Putter, blockNumber uint64, histogram *Histogram) error {
+	value := make([]byte, HistogramBuckets*8)
+	for i, count := range histogram {
+		binary.BigEndian.PutUint64(value[i*8:], count)
+	}
+	return db.Put(HistogramBucketName, keyFromBlockNumber(blockNumber), value)
+}
+
+func GetHistogramForBlock(db ethdb.Getter, blockNumber uint64) (*Histogram, error) {
+	bytes, err := db.Get(HistogramBucketName, keyFromBlockNumber(blockNumber))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeHistogram(bytes)
+}
+
+func DeleteHistogramForBlock(db ethdb.Deleter, blockNumber uint64) error {
+	return db.Delete(HistogramBucketName, keyFromBlockNumber(blockNumber), nil)
+}
+
+// FindHistogram returns the histogram of the closest block at or before `blockNumber` that has it stored.
+// It returns ethdb.ErrKeyNotFound if there is no such block.
+func FindHistogram(tx ethdb.Tx, blockNumber uint64) (uint64, *Histogram, error) {
+	k, v, err := seekAtOrBefore(tx, HistogramBucketName, blockNumber)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	histogram, err := decodeHistogram(v)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return binary.BigEndian.Uint64(k), histogram, nil
+}
+
+// histogramAt returns the histogram at the block. If it isn't stored, it is calculated
+// from the closest stored one by replaying the changesets between them.
+func histogramAt(db ethdb.Database, blockNumber uint64) (*Histogram, error) {
+	histogram, err := GetHistogramForBlock(db, blockNumber)
+	if err != ethdb.ErrKeyNotFound {
+		return histogram, err
+	}
+
+	hasTx, ok := db.(ethdb.HasTx)
+	if !ok || hasTx.Tx() == nil {
+		return nil, fmt.Errorf("should be a transaction, got %T", db)
+	}
+
+	storedAt, histogram, err := FindHistogram(hasTx.Tx(), blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the histogram is used, so the watchlist doesn't matter
+	err = forEachDelta(db, storedAt+1, blockNumber, nil, func(_ uint64, delta *supplyDelta) error {
+		delta.applyToHistogram(histogram)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return histogram, nil
+}
+
+func decodeHistogram(enc []byte) (*Histogram, error) {
+	if len(enc) != HistogramBuckets*8 {
+		return nil, fmt.Errorf("malformed balance histogram: %x", enc)
+	}
+
+	histogram := &Histogram{}
+	for i := range histogram {
+		histogram[i] = binary.BigEndian.Uint64(enc[i*8:])
+	}
+
+	return histogram, nil
+}
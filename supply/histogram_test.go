@@ -0,0 +1,98 @@
+package supply
+
+import (
+	"context"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestHistogramBucket(t *testing.T) {
+	for _, tc := range []struct {
+		balance *uint256.Int
+		bucket  int
+	}{
+		{uint256.NewInt().SetUint64(1), 0},
+		{uint256.NewInt().SetUint64(1e16 - 1), 0},
+		{uint256.NewInt().SetUint64(1e16), 1},
+		{uint256.NewInt().Sub(ether(1), uint256.NewInt().SetUint64(1)), 1},
+		{ether(1), 2},
+		{ether(99_999), 6},
+		{ether(100_000), 7},
+		{ether(100_000_000), 7},
+	} {
+		if bucket := histogramBucket(tc.balance); bucket != tc.bucket {
+			t.Errorf("balance %d: bucket %d, expected %d", tc.balance, bucket, tc.bucket)
+		}
+	}
+}
+
+func TestFindHistogram(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, blockNumber := range []uint64{10, 20, 25} {
+		if err := SetHistogramForBlock(db, blockNumber, &Histogram{blockNumber}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.RwKV().Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for _, tc := range []struct{ blockNumber, found uint64 }{
+		{10, 10},
+		{19, 10},
+		{20, 20},
+		{24, 20},
+		{1000, 25},
+	} {
+		found, histogram, err := FindHistogram(tx, tc.blockNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != tc.found || histogram[0] != tc.found {
+			t.Errorf("block %d: found %d %v, expected %d", tc.blockNumber, found, histogram, tc.found)
+		}
+	}
+
+	if _, _, err = FindHistogram(tx, 9); err != ethdb.ErrKeyNotFound {
+		t.Errorf("block 9: expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestHistogramAt(t *testing.T) {
+	db := newTestChain(t, 100, 20, 500)
+
+	backward := make([]Totals, 101)
+	err := calculateBackward(db, 1, 100, BackwardConfig{}, func(blockNumber uint64, totals *Totals) error {
+		backward[blockNumber] = *totals
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err = SetHistogramForBlock(tx, 50, &backward[50].Histogram); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, blockNumber := range []uint64{50, 51, 80, 100} {
+		histogram, err := histogramAt(tx, blockNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *histogram != backward[blockNumber].Histogram {
+			t.Errorf("block %d: %v, expected %v", blockNumber, histogram, backward[blockNumber].Histogram)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package supply
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const HoldersBucketName = "org.ffconsulting.tg.db.ETH_HOLDERS"
+
+// SetHolderCountForBlock stores the number of accounts with non-zero balance at the block.
+func SetHolderCountForBlock(db ethdb.Putter, blockNumber uint64, holders uint64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, holders)
+	return db.Put(HoldersBucketName, keyFromBlockNumber(blockNumber), value)
+}
+
+func GetHolderCountForBlock(db ethdb.Getter, blockNumber uint64) (uint64, error) {
+	bytes, err := db.Get(HoldersBucketName, keyFromBlockNumber(blockNumber))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(bytes) != 8 {
+		return 0, fmt.Errorf("malformed holder count: %x", bytes)
+	}
+
+	return binary.BigEndian.Uint64(bytes), nil
+}
+
+func DeleteHolderCountForBlock(db ethdb.Deleter, blockNumber uint64) error {
+	return db.Delete(HoldersBucketName, keyFromBlockNumber(blockNumber), nil)
+}
@@ -0,0 +1,179 @@
+package supply
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+const IssuanceBucketName = "org.ffconsulting.tg.db.ETH_ISSUANCE"
+
+// Issuance is a breakdown of the ETH supply change in a single block.
+// supply(N) = supply(N-1) + BlockReward + UncleReward - UnexplainedDecrease + UnexplainedIncrease
+//
+// Transaction fees only move ETH from the senders to the miner, so they don't
+// change the supply and aren't a part of the breakdown.
+type Issuance struct {
+	// BlockReward is the reward of the block miner (including the reward for the included uncles).
+	BlockReward uint256.Int
+	// UncleReward is the sum of the rewards of the uncle miners.
+	UncleReward uint256.Int
+	// UnexplainedDecrease and UnexplainedIncrease are the net supply change the rewards don't explain,
+	// at most one of them is non-zero. The ETH burned by self-destructs and created by irregular state changes
+	// in the same block offset each other, so they aren't tracked separately.
+	UnexplainedDecrease uint256.Int
+	UnexplainedIncrease uint256.Int
+}
+
+// CalculateIssuance splits the supply change of every block between `from` and `to` into its components.
+// It depends on the supply being already calculated for the blocks `from-1`...`to`.
+// Block rewards are taken from the fork schedule of the chain config. The chains with the clique (proof-of-authority)
+// engine don't have them, so their issuance is zero and all the supply changes are unexplained.
+func CalculateIssuance(db ethdb.Database, config *params.ChainConfig, from, to uint64) error {
+	if from > to {
+		from, to = to, from
+	}
+
+	// the genesis allocation isn't an issuance, so we start from the block 1
+	if from == 0 {
+		from = 1
+	}
+
+	p := message.NewPrinter(language.English)
+	start := time.Now()
+
+	previousSupply, err := GetSupplyForBlock(db, from-1)
+	if err != nil {
+		return fmt.Errorf("no supply for the block %d to calculate issuance: %w", from-1, err)
+	}
+
+	expectedSupply := uint256.NewInt()
+
+	for blockNumber := from; blockNumber <= to; blockNumber++ {
+		supply, err := GetSupplyForBlock(db, blockNumber)
+		if err != nil {
+			return fmt.Errorf("no supply for the block %d to calculate issuance: %w", blockNumber, err)
+		}
+
+		var issuance Issuance
+
+		err = calculateRewards(db, config, blockNumber, &issuance)
+		if err != nil {
+			return err
+		}
+
+		expectedSupply.Add(previousSupply, &issuance.BlockReward)
+		expectedSupply.Add(expectedSupply, &issuance.UncleReward)
+
+		// the rest of the change is only known as a net value
+		if supply.Lt(expectedSupply) {
+			issuance.UnexplainedDecrease.Sub(expectedSupply, supply)
+		} else {
+			issuance.UnexplainedIncrease.Sub(supply, expectedSupply)
+		}
+
+		if err = SetIssuanceForBlock(db, blockNumber, &issuance); err != nil {
+			return err
+		}
+
+		if blockNumber%100_000 == 0 {
+			log.Info(p.Sprintf("Issuance: blockNum=%d\n\tblock reward=%d\n\tuncle reward=%d\n\tunexplained decrease=%d\n\tunexplained increase=%d",
+				blockNumber, &issuance.BlockReward, &issuance.UncleReward, &issuance.UnexplainedDecrease, &issuance.UnexplainedIncrease),
+				"eta", estimateETA(time.Since(start), blockNumber-from+1, to-from+1))
+		}
+
+		previousSupply = supply
+	}
+
+	return nil
+}
+
+func calculateRewards(db ethdb.Database, config *params.ChainConfig, blockNumber uint64, issuance *Issuance) error {
+	// the engine is picked like ethconfig.CreateConsensusEngine does: clique if it is configured, ethash otherwise.
+	// Clique chains (Rinkeby, Goerli) don't have block rewards
+	if config.Clique != nil {
+		return nil
+	}
+
+	hash, err := rawdb.ReadCanonicalHash(db, blockNumber)
+	if err != nil {
+		return err
+	}
+
+	header := rawdb.ReadHeader(db, hash, blockNumber)
+	if header == nil {
+		return fmt.Errorf("no header for the block %d", blockNumber)
+	}
+
+	body, _, _ := rawdb.ReadBodyWithoutTransactions(db, hash, blockNumber)
+	if body == nil {
+		return fmt.Errorf("no body for the block %d", blockNumber)
+	}
+
+	minerReward, uncleRewards := ethash.AccumulateRewards(config, header, body.Uncles)
+
+	issuance.BlockReward.Set(&minerReward)
+	for i := range uncleRewards {
+		issuance.UncleReward.Add(&issuance.UncleReward, &uncleRewards[i])
+	}
+
+	return nil
+}
+
+func SetIssuanceForBlock(db ethdb.Putter, blockNumber uint64, issuance *Issuance) error {
+	return db.Put(IssuanceBucketName, keyFromBlockNumber(blockNumber), encodeIssuance(issuance))
+}
+
+func GetIssuanceForBlock(db ethdb.Getter, blockNumber uint64) (*Issuance, error) {
+	bytes, err := db.Get(IssuanceBucketName, keyFromBlockNumber(blockNumber))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeIssuance(bytes)
+}
+
+func DeleteIssuanceForBlock(db ethdb.Deleter, blockNumber uint64) error {
+	return db.Delete(IssuanceBucketName, keyFromBlockNumber(blockNumber), nil)
+}
+
+// the values are stored one after another, each one is prefixed by its length
+func encodeIssuance(issuance *Issuance) []byte {
+	buffer := make([]byte, 0, 4*(1+32))
+	for _, value := range []*uint256.Int{&issuance.BlockReward, &issuance.UncleReward, &issuance.UnexplainedDecrease, &issuance.UnexplainedIncrease} {
+		valueBytes := value.Bytes()
+		buffer = append(buffer, byte(len(valueBytes)))
+		buffer = append(buffer, valueBytes...)
+	}
+	return buffer
+}
+
+func decodeIssuance(enc []byte) (*Issuance, error) {
+	issuance := &Issuance{}
+
+	pos := 0
+	for _, value := range []*uint256.Int{&issuance.BlockReward, &issuance.UncleReward, &issuance.UnexplainedDecrease, &issuance.UnexplainedIncrease} {
+		if len(enc) < pos+1 {
+			return nil, fmt.Errorf("malformed issuance value: %x", enc)
+		}
+
+		length := int(enc[pos])
+		if length > 32 || len(enc) < pos+1+length {
+			return nil, fmt.Errorf("malformed issuance value: %x", enc)
+		}
+
+		value.SetBytes(enc[pos+1 : pos+1+length])
+		pos += 1 + length
+	}
+
+	return issuance, nil
+}
@@ -0,0 +1,156 @@
+package supply
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+func gwei(amount uint64) *uint256.Int {
+	return uint256.NewInt().Mul(uint256.NewInt().SetUint64(amount), uint256.NewInt().SetUint64(1e9))
+}
+
+// writeIssuanceChain writes the headers and the bodies of the blocks 0...len(uncles)-1,
+// the block N includes the uncles with the block numbers `uncles[N]`,
+// and the supply that changes by `changes[N]` gwei in the block N.
+func writeIssuanceChain(t *testing.T, db ethdb.Database, uncles [][]uint64, changes []uint64) {
+	supply := uint256.NewInt()
+
+	for blockNumber := range uncles {
+		header := &types.Header{Number: big.NewInt(int64(blockNumber))}
+		body := &types.Body{}
+		for _, uncleNumber := range uncles[blockNumber] {
+			body.Uncles = append(body.Uncles, &types.Header{Number: new(big.Int).SetUint64(uncleNumber)})
+		}
+		header.UncleHash = types.CalcUncleHash(body.Uncles)
+
+		rawdb.WriteHeader(context.Background(), db, header)
+		if err := rawdb.WriteBody(db, header.Hash(), uint64(blockNumber), body); err != nil {
+			t.Fatal(err)
+		}
+		if err := rawdb.WriteCanonicalHash(db, header.Hash(), uint64(blockNumber)); err != nil {
+			t.Fatal(err)
+		}
+
+		supply.Add(supply, gwei(changes[blockNumber]))
+		if err := SetSupplyForBlock(db, uint64(blockNumber), header.Hash(), supply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := stages.SaveStageProgress(db, StageID, uint64(len(uncles)-1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCalculateIssuance(t *testing.T) {
+	// the rewards change at the Byzantium (block 4) and the Constantinople (block 6) forks
+	config := &params.ChainConfig{
+		ChainID:             big.NewInt(1),
+		ByzantiumBlock:      big.NewInt(4),
+		ConstantinopleBlock: big.NewInt(6),
+		Ethash:              new(params.EthashConfig),
+	}
+
+	uncles := [][]uint64{
+		0: nil,
+		1: nil,
+		2: {1, 0}, // the uncles at the distance 1 and 2
+		3: nil,
+		4: {3},
+		5: nil,
+		6: {5},
+		7: nil,
+	}
+
+	// block reward + uncle reward + unexplained increase - unexplained decrease (in gwei)
+	changes := []uint64{
+		0: 72_000_000_000,
+		1: 5e9,
+		2: 5e9 + 5e9/32*2 + 5e9*7/8 + 5e9*6/8,
+		3: 5e9 + 1, // increase
+		4: 3e9 + 3e9/32 + 3e9*7/8,
+		5: 3e9 - 2, // decrease
+		6: 2e9 + 2e9/32 + 2e9*7/8,
+		7: 2e9,
+	}
+
+	expected := []struct {
+		blockReward, uncleReward, decrease, increase uint64
+	}{
+		1: {blockReward: 5e9},
+		2: {blockReward: 5e9 + 5e9/32*2, uncleReward: 5e9*7/8 + 5e9*6/8},
+		3: {blockReward: 5e9, increase: 1},
+		4: {blockReward: 3e9 + 3e9/32, uncleReward: 3e9 * 7 / 8},
+		5: {blockReward: 3e9, decrease: 2},
+		6: {blockReward: 2e9 + 2e9/32, uncleReward: 2e9 * 7 / 8},
+		7: {blockReward: 2e9},
+	}
+
+	db := newTestDB(t)
+	writeIssuanceChain(t, db, uncles, changes)
+
+	if err := CalculateIssuance(db, config, 0, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	for blockNumber := uint64(1); blockNumber <= 7; blockNumber++ {
+		issuance, err := GetIssuanceForBlock(db, blockNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := expected[blockNumber]
+		for _, value := range []struct {
+			name             string
+			actual, expected *uint256.Int
+		}{
+			{"block reward", &issuance.BlockReward, gwei(e.blockReward)},
+			{"uncle reward", &issuance.UncleReward, gwei(e.uncleReward)},
+			{"unexplained decrease", &issuance.UnexplainedDecrease, gwei(e.decrease)},
+			{"unexplained increase", &issuance.UnexplainedIncrease, gwei(e.increase)},
+		} {
+			if !value.actual.Eq(value.expected) {
+				t.Errorf("block %d: %s %d, expected %d", blockNumber, value.name, value.actual, value.expected)
+			}
+		}
+	}
+
+	// the block 0 is the genesis allocation
+	if _, err := GetIssuanceForBlock(db, 0); err != ethdb.ErrKeyNotFound {
+		t.Errorf("block 0: expected no issuance, got %v", err)
+	}
+}
+
+func TestCalculateIssuanceClique(t *testing.T) {
+	config := &params.ChainConfig{
+		ChainID:        big.NewInt(4),
+		ByzantiumBlock: big.NewInt(0),
+		Clique:         &params.CliqueConfig{Period: 15, Epoch: 30000},
+	}
+
+	db := newTestDB(t)
+	writeIssuanceChain(t, db, [][]uint64{nil, nil, nil}, []uint64{1e9, 0, 5})
+
+	if err := CalculateIssuance(db, config, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// no rewards, so all the changes are unexplained
+	for blockNumber, increase := range map[uint64]uint64{1: 0, 2: 5} {
+		issuance, err := GetIssuanceForBlock(db, blockNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !issuance.BlockReward.IsZero() || !issuance.UncleReward.IsZero() || !issuance.UnexplainedDecrease.IsZero() || !issuance.UnexplainedIncrease.Eq(gwei(increase)) {
+			t.Errorf("block %d: expected only %d gwei unexplained increase, got %+v", blockNumber, increase, issuance)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package supply
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+
+	"github.com/holiman/uint256"
+)
+
+const FormatBucketName = "org.ffconsulting.tg.db.ETH_SUPPLY_FORMAT"
+
+// FormatVersion is the version of the on-disk format of the supply buckets that this code works with.
+// It is the version of the last migration.
+const FormatVersion = 7
+
+// legacyBucketName and legacyStageID are the bucket and the stage of the format version 1.
+const legacyBucketName = "org.ffconsulting.tg.db.ETH_SUPPLY"
+
+var legacyStageID = stages.SyncStage("org.ffconsulting.ETH_SUPPLY")
+
+var formatVersionKey = []byte("version")
+
+// ErrUnknownFormat means that the supply data in the DB was written by a newer version of this code.
+var ErrUnknownFormat = errors.New("unknown ETH supply format")
+
+// Migration converts the supply data from the format version `Version-1` to `Version`.
+type Migration struct {
+	Version uint64
+	Name    string
+	// Up converts the data in place, it is called in the same transaction that saves the new version.
+	Up func(tx ethdb.DbWithPendingMutations) error
+}
+
+// migrations are all the format changes, sorted by version.
+var migrations = []Migration{
+	{Version: 2, Name: "move the supply from the v1 bucket", Up: migrateLegacyBucket},
+	{Version: 3, Name: "recalculate with the holder counts", Up: recalculateAll},
+	{Version: 4, Name: "recalculate with the balance histograms", Up: recalculateAll},
+	{Version: 5, Name: "recalculate with the contract supply", Up: recalculateAll},
+	{Version: 6, Name: "recalculate with the locked supply", Up: recalculateAll},
+	{Version: 7, Name: "store the block hashes with the supply", Up: addSupplyBlockHashes},
+}
+
+// Migrate converts the supply data in the DB to the current format.
+// It returns ErrUnknownFormat if the data is newer than this code.
+func Migrate(db ethdb.Database) error {
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	version, err := formatVersion(tx)
+	if err != nil {
+		return err
+	}
+
+	if version > FormatVersion {
+		return unknownFormatError(version)
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		log.Info("Migrating the ETH supply", "version", migration.Version, "migration", migration.Name)
+		if err = migration.Up(tx); err != nil {
+			return fmt.Errorf("migration to the ETH supply format version %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+
+		version = migration.Version
+	}
+
+	if err = writeFormatVersion(tx, version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CheckFormatVersion returns an error if the supply data in the DB isn't in the current format.
+// Unlike Migrate, it doesn't change anything, so it can be used with read-only transactions.
+func CheckFormatVersion(db ethdb.Database) error {
+	version, err := formatVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > FormatVersion {
+		return unknownFormatError(version)
+	}
+
+	if version < FormatVersion {
+		return fmt.Errorf("the ETH supply format version %d is outdated, run `cmd/supply` to migrate it to the version %d", version, FormatVersion)
+	}
+
+	return nil
+}
+
+// ReadFormatVersion returns the saved format version, 0 if it isn't saved.
+func ReadFormatVersion(db ethdb.Getter) (uint64, error) {
+	enc, err := db.Get(FormatBucketName, formatVersionKey)
+	if err == ethdb.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if len(enc) != 8 {
+		return 0, fmt.Errorf("malformed ETH supply format version: %x", enc)
+	}
+
+	return binary.BigEndian.Uint64(enc), nil
+}
+
+func writeFormatVersion(db ethdb.Putter, version uint64) error {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, version)
+	return db.Put(FormatBucketName, formatVersionKey, enc)
+}
+
+// formatVersion returns the format version of the data in the DB.
+// The DBs before the format versioning are detected by the buckets they have.
+func formatVersion(db ethdb.Database) (uint64, error) {
+	version, err := ReadFormatVersion(db)
+	if err != nil || version != 0 {
+		return version, err
+	}
+
+	legacyExists, err := bucketExists(db, legacyBucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	if legacyExists {
+		return 1, nil
+	}
+
+	// the v2 bucket was written before the format versioning, an empty one is a new DB
+	hasValues, err := bucketHasValues(db, BucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	if hasValues {
+		return 2, nil
+	}
+
+	return FormatVersion, nil
+}
+
+func bucketHasValues(db ethdb.Getter, name string) (bool, error) {
+	hasValues := false
+	err := db.Walk(name, nil, 0, func(_, _ []byte) (bool, error) {
+		hasValues = true
+		return false, nil
+	})
+	return hasValues, err
+}
+
+func bucketExists(db ethdb.Database, name string) (bool, error) {
+	hasTx, ok := db.(ethdb.HasTx)
+	if !ok || hasTx.Tx() == nil {
+		return false, fmt.Errorf("should be a transaction, got %T", db)
+	}
+
+	migrator, ok := hasTx.Tx().(ethdb.BucketMigrator)
+	if !ok {
+		return false, fmt.Errorf("%T doesn't support bucket operations", hasTx.Tx())
+	}
+
+	return migrator.ExistsBucket(name), nil
+}
+
+func unknownFormatError(version uint64) error {
+	return fmt.Errorf("%w: the DB has the format version %d, the latest supported one is %d. Please, update `cmd/supply`", ErrUnknownFormat, version, FormatVersion)
+}
+
+// migrateLegacyBucket moves the supply from the v1 bucket to the current one.
+// The values have the same encoding, so they are copied as is.
+// If the current bucket already has values, they are newer, so only the missing blocks are copied.
+func migrateLegacyBucket(tx ethdb.DbWithPendingMutations) error {
+	hasValues, err := bucketHasValues(tx, BucketName)
+	if err != nil {
+		return err
+	}
+
+	copied := 0
+	err = tx.Walk(legacyBucketName, nil, 0, func(k, v []byte) (bool, error) {
+		_, err := tx.Get(BucketName, k)
+		if err == nil {
+			// there is a newer value
+			return true, nil
+		} else if err != ethdb.ErrKeyNotFound {
+			return false, err
+		}
+
+		copied++
+		return true, tx.Put(BucketName, common.CopyBytes(k), common.CopyBytes(v))
+	})
+	if err != nil {
+		return err
+	}
+
+	legacyProgress, err := stages.GetStageProgress(tx, legacyStageID)
+	if err != nil {
+		return err
+	}
+
+	if !hasValues && legacyProgress > 0 {
+		// continue from where the v1 stage stopped
+		if err = stages.SaveStageProgress(tx, StageID, legacyProgress); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Delete(dbutils.SyncStageProgress, []byte(legacyStageID), nil); err != nil {
+		return err
+	}
+
+	log.Info("Moved the ETH supply from the v1 bucket", "blocks", copied, "stageProgress", legacyProgress)
+
+	return tx.(ethdb.HasTx).Tx().(ethdb.BucketMigrator).DropBucket(legacyBucketName)
+}
+
+// addSupplyBlockHashes adds the canonical block hashes to the stored supply values (see ErrStaleSupply).
+// The values are taken as they are, so the supply that is already stale can't be detected.
+func addSupplyBlockHashes(tx ethdb.DbWithPendingMutations) error {
+	c := tx.(ethdb.HasTx).Tx().(ethdb.RwTx).RwCursor(BucketName)
+	defer c.Close()
+
+	migrated := 0
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+
+		blockHash, err := rawdb.ReadCanonicalHash(tx, binary.BigEndian.Uint64(k))
+		if err != nil {
+			return err
+		}
+
+		if err = c.Put(common.CopyBytes(k), encodeSupply(blockHash, uint256.NewInt().SetBytes(v))); err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	log.Info("Added the block hashes to the ETH supply", "blocks", migrated)
+	return nil
+}
+
+// recalculateAll makes the stage calculate everything again, for the values that can't be derived from the stored ones.
+// The old checkpoints don't have everything the new calculation needs either, so the checkpoint is removed too.
+func recalculateAll(tx ethdb.DbWithPendingMutations) error {
+	progress, err := stages.GetStageProgress(tx, StageID)
+	if err != nil {
+		return err
+	}
+
+	if progress > 0 {
+		log.Info("The ETH supply will be calculated again from genesis", "stageProgress", progress)
+	}
+
+	return resetStage(tx)
+}
+
+// resetStage makes the stage calculate everything from genesis.
+// The stored values are overwritten by the new calculation.
+func resetStage(db ethdb.Database) error {
+	if err := DeleteBackwardCheckpoint(db); err != nil {
+		return err
+	}
+
+	return stages.SaveStageProgress(db, StageID, 0)
+}
@@ -0,0 +1,85 @@
+package supply
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// TestMigrateBaseline migrates the DB written before the format versioning.
+func TestMigrateBaseline(t *testing.T) {
+	h := newSyncHarness(t, Config{})
+	h.execute(20)
+
+	// the baseline stores only the supply of every block, in the v2 bucket and without the format version
+	for blockNumber := uint64(0); blockNumber <= h.head(); blockNumber++ {
+		if err := h.tx.Put(BucketName, keyFromBlockNumber(blockNumber), h.expectedSupply(blockNumber).Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stages.SaveStageProgress(h.tx, StageID, h.head()); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(h.db); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := h.db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tx.Rollback)
+	h.tx = tx
+
+	if err = CheckFormatVersion(h.tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the values added after the baseline are calculated from genesis again
+	if progress, err := stages.GetStageProgress(h.tx, StageID); err != nil || progress != 0 {
+		t.Fatalf("expected the stage progress 0, got %d (%v)", progress, err)
+	}
+
+	// the old values are readable until they are overwritten
+	for blockNumber := uint64(0); blockNumber <= h.head(); blockNumber++ {
+		if supply, err := readStoredSupply(h.tx, blockNumber); err != nil || supply == nil || !supply.Eq(h.expectedSupply(blockNumber)) {
+			t.Errorf("block %d: expected the supply %d, got %v (%v)", blockNumber, h.expectedSupply(blockNumber), supply, err)
+		}
+	}
+
+	h.sync(StrategyForward)
+	h.check()
+}
+
+func TestFormatVersion(t *testing.T) {
+	tx, err := newTestDB(t).Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// a new DB
+	if version, err := formatVersion(tx); err != nil || version != FormatVersion {
+		t.Fatalf("expected the version %d for an empty DB, got %d (%v)", FormatVersion, version, err)
+	}
+
+	if err = tx.Put(BucketName, keyFromBlockNumber(0), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := formatVersion(tx); err != nil || version != 2 {
+		t.Fatalf("expected the version 2 for the values without the version, got %d (%v)", version, err)
+	}
+
+	if err = writeFormatVersion(tx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := formatVersion(tx); err != nil || version != 5 {
+		t.Fatalf("expected the saved version 5, got %d (%v)", version, err)
+	}
+}
@@ -0,0 +1,146 @@
+package supply
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/metrics"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// The metrics of the supply calculation, turbo-geth publishes them with `--metrics`
+// (`/debug/metrics/prometheus` on `--metrics.addr` and `--metrics.port`).
+var (
+	// blocksCounter is the number of blocks calculated since the start.
+	blocksCounter = metrics.NewRegisteredCounter("supply/blocks", nil)
+	// blockGauge is the last calculated block.
+	blockGauge = metrics.NewRegisteredGauge("supply/block", nil)
+	// accountsCounter is the number of accounts read from the current state since the start.
+	accountsCounter = metrics.NewRegisteredCounter("supply/accounts", nil)
+	// forwardGauge and backwardGauge are 1 while the calculation with this strategy is running.
+	forwardGauge  = metrics.NewRegisteredGauge("supply/strategy/forward", nil)
+	backwardGauge = metrics.NewRegisteredGauge("supply/strategy/backward", nil)
+	// elapsedGauge and etaGauge are the seconds since the start of the calculation and until its end.
+	elapsedGauge = metrics.NewRegisteredGauge("supply/elapsed", nil)
+	etaGauge     = metrics.NewRegisteredGauge("supply/eta", nil)
+)
+
+// estimateETA returns the time left to process `total` items if `done` of them took `elapsed`, 0 if it is unknown.
+func estimateETA(elapsed time.Duration, done, total uint64) time.Duration {
+	if done == 0 || done >= total {
+		return 0
+	}
+	return time.Duration(float64(elapsed) / float64(done) * float64(total-done)).Round(time.Second)
+}
+
+// progress tracks the calculation of the supply for a range of blocks, it updates the metrics
+// and logs the stats with the estimated time left every `logEvery` blocks.
+type progress struct {
+	strategy Strategy
+	blocks   uint64
+	logEvery uint64
+
+	// start is the start of the calculation, firstBlock is when the first block is calculated
+	// (the backward calculation reads the current state before that)
+	start, firstBlock time.Time
+	done              uint64
+
+	printer *message.Printer
+}
+
+// newProgress starts tracking the calculation of `blocks` blocks with the strategy.
+func newProgress(strategy Strategy, blocks, logEvery uint64) *progress {
+	if strategy == StrategyBackward {
+		forwardGauge.Update(0)
+		backwardGauge.Update(1)
+	} else {
+		forwardGauge.Update(1)
+		backwardGauge.Update(0)
+	}
+	etaGauge.Update(0)
+
+	return &progress{
+		strategy: strategy,
+		blocks:   blocks,
+		logEvery: logEvery,
+		start:    time.Now(),
+		printer:  message.NewPrinter(language.English),
+	}
+}
+
+// eta returns the estimated time left, it is based on the speed of calculating the blocks only.
+func (p *progress) eta() time.Duration {
+	if p.done == 0 {
+		return 0
+	}
+	return estimateETA(time.Since(p.firstBlock), p.done, p.blocks)
+}
+
+// track wraps the callback of the calculation, so every calculated block is tracked.
+func (p *progress) track(onBlock func(blockNumber uint64, totals *Totals) error) func(blockNumber uint64, totals *Totals) error {
+	return func(blockNumber uint64, totals *Totals) error {
+		if err := onBlock(blockNumber, totals); err != nil {
+			return err
+		}
+
+		if p.done == 0 {
+			p.firstBlock = time.Now()
+		}
+		p.done++
+
+		eta := p.eta()
+
+		blocksCounter.Inc(1)
+		blockGauge.Update(int64(blockNumber))
+		elapsedGauge.Update(int64(time.Since(p.start).Seconds()))
+		etaGauge.Update(int64(eta.Seconds()))
+
+		if blockNumber%p.logEvery == 0 {
+			// this could be used to compare data with
+			// https://github.com/lastmjs/eth-total-supply#total-eth-supply
+			log.Info(p.printer.Sprintf("Stats: blockNum=%d\n\tholders=%d\n\tsupply=%d", blockNumber, totals.Holders, &totals.Supply),
+				"strategy", p.strategy, "blocks", p.done, "of", p.blocks, "eta", eta)
+		}
+
+		return nil
+	}
+}
+
+// finish marks the end of the calculation.
+func (p *progress) finish() {
+	elapsedGauge.Update(int64(time.Since(p.start).Seconds()))
+	etaGauge.Update(0)
+	forwardGauge.Update(0)
+	backwardGauge.Update(0)
+}
+
+// scanProgress tracks reading the current state, the time left is estimated from the number of accounts
+// in the previous scan (see Throughput), if there was one.
+type scanProgress struct {
+	start     time.Time
+	expected  uint64
+	processed uint64
+
+	printer *message.Printer
+}
+
+func newScanProgress(expected uint64) *scanProgress {
+	return &scanProgress{start: time.Now(), expected: expected, printer: message.NewPrinter(language.English)}
+}
+
+// onAccount can be called by the workers that read the state in parallel.
+func (p *scanProgress) onAccount() {
+	processed := atomic.AddUint64(&p.processed, 1)
+	accountsCounter.Inc(1)
+
+	if processed%100_000 == 0 {
+		eta := estimateETA(time.Since(p.start), processed, p.expected)
+		elapsedGauge.Update(int64(time.Since(p.start).Seconds()))
+		etaGauge.Update(int64(eta.Seconds()))
+
+		log.Info(p.printer.Sprintf("Processed %d account records in current state", processed), "eta", eta)
+	}
+}
@@ -0,0 +1,57 @@
+package supply
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEstimateETA(t *testing.T) {
+	for _, tc := range []struct {
+		elapsed     time.Duration
+		done, total uint64
+		expected    time.Duration
+	}{
+		{time.Minute, 10, 40, 3 * time.Minute},
+		{time.Minute, 40, 40, 0},
+		// nothing is done yet or the total is unknown
+		{time.Minute, 0, 40, 0},
+		{time.Minute, 10, 0, 0},
+	} {
+		if eta := estimateETA(tc.elapsed, tc.done, tc.total); eta != tc.expected {
+			t.Errorf("%s for %d of %d: ETA %s, expected %s", tc.elapsed, tc.done, tc.total, eta, tc.expected)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	p := newProgress(StrategyForward, 10, 5)
+	defer p.finish()
+
+	errStop := errors.New("stop")
+
+	var calculated []uint64
+	onBlock := p.track(func(blockNumber uint64, _ *Totals) error {
+		if blockNumber == 7 {
+			return errStop
+		}
+		calculated = append(calculated, blockNumber)
+		return nil
+	})
+
+	for blockNumber := uint64(0); blockNumber < 7; blockNumber++ {
+		if err := onBlock(blockNumber, &Totals{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := onBlock(7, &Totals{}); err != errStop {
+		t.Fatalf("expected the error of the callback, got %v", err)
+	}
+
+	if len(calculated) != 7 || p.done != 7 {
+		t.Errorf("calculated %v (%d blocks tracked), expected 7 blocks", calculated, p.done)
+	}
+	if p.eta() < 0 {
+		t.Errorf("negative ETA %s", p.eta())
+	}
+}
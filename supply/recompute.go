@@ -0,0 +1,225 @@
+package supply
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// BlockTotals are the totals calculated for a block by DryRun.
+type BlockTotals struct {
+	BlockNumber uint64
+	Totals      Totals
+	// Stored is the value from `BucketName` (or replayed from the closest stored one), `nil` if there is none
+	Stored *uint256.Int
+}
+
+func (b *BlockTotals) String() string {
+	stored := "<none>"
+	if b.Stored != nil {
+		stored = b.Stored.ToBig().String()
+	}
+	return fmt.Sprintf("block=%d supply=%s contracts=%s locked=%s holders=%d stored=%s",
+		b.BlockNumber, b.Totals.Supply.ToBig().String(), b.Totals.ContractSupply.ToBig().String(), b.Totals.LockedSupply.ToBig().String(), b.Totals.Holders, stored)
+}
+
+// DryRun calculates the ETH supply forward for blocks `from`...`to` and passes the totals of every block to `onBlock`.
+// It doesn't write anything, so it can be used with a read-only transaction.
+// The calculation starts from the stored totals of the closest block before `from`, like CalculateForward does.
+func DryRun(db ethdb.Database, genesis *core.Genesis, from, to uint64, cfg Config, onBlock func(*BlockTotals)) error {
+	if from > to {
+		from, to = to, from
+	}
+
+	currentStateAt, err := stages.GetStageProgress(db, stages.Execution)
+	if err != nil {
+		return err
+	}
+
+	if to > currentStateAt {
+		return fmt.Errorf("can't calculate beyond the current state: to=%d, current state at %d", to, currentStateAt)
+	}
+
+	tip, err := stages.GetStageProgress(db, StageID)
+	if err != nil {
+		return err
+	}
+
+	start, totals, err := initialTotals(db, from, cfg)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Calculating ETH supply without writing", "from", start, "to", to)
+
+	// the stored supply of the previous block, the pruned blocks are replayed from it with the calculated changes,
+	// so the range is walked only once
+	var stored *uint256.Int
+	var previousSupply uint256.Int
+
+	return calculateForward(db, genesis, start, to, cfg.Watchlist, totals, func(blockNumber uint64, totals *Totals) error {
+		if blockNumber < from {
+			return nil
+		}
+
+		var err error
+		if blockNumber == from {
+			stored, err = GetSupplyForBlock(db, blockNumber)
+			if errors.Is(err, ethdb.ErrKeyNotFound) || errors.Is(err, ErrStaleSupply) {
+				stored, err = nil, nil
+			}
+		} else {
+			stored, err = nextStoredSupply(db, blockNumber, tip, stored, uint256.NewInt().Sub(&totals.Supply, &previousSupply))
+		}
+		if err != nil {
+			return err
+		}
+
+		previousSupply = totals.Supply
+		onBlock(&BlockTotals{BlockNumber: blockNumber, Totals: *totals, Stored: stored})
+		return nil
+	})
+}
+
+// nextStoredSupply returns what GetSupplyForBlock returns for the block (`nil` instead of the errors) when
+// `previous` is that of the block before it and `change` is the supply change of the block.
+func nextStoredSupply(db ethdb.Getter, blockNumber, tip uint64, previous, change *uint256.Int) (*uint256.Int, error) {
+	if blockNumber > tip {
+		return nil, nil
+	}
+
+	enc, err := db.Get(BucketName, keyFromBlockNumber(blockNumber))
+	if err == ethdb.ErrKeyNotFound {
+		// pruned, replayed from the previous block unless it is stale too
+		if previous == nil {
+			return nil, nil
+		}
+		return uint256.NewInt().Add(previous, change), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	supply, err := decodeCanonicalSupply(db, blockNumber, enc)
+	if errors.Is(err, ErrStaleSupply) {
+		return nil, nil
+	}
+	return supply, err
+}
+
+// Recompute calculates the ETH supply and the issuance for blocks `from`...`to` again and overwrites the stored values,
+// the values of the other blocks are kept. The totals of the block before `from` are trusted, like in CalculateForward.
+// The blocks can't be after the stage progress, the stage calculates them. The rich lists and the concentration
+// of the backward calculation are kept too, the forward calculation doesn't know the balances.
+// It returns the number of blocks which stored supply was different, stale or missing (if it isn't pruned).
+func Recompute(db ethdb.Database, genesis *core.Genesis, chainConfig *params.ChainConfig, from, to uint64, cfg Config) (int, error) {
+	if from > to {
+		from, to = to, from
+	}
+
+	tip, err := stages.GetStageProgress(db, StageID)
+	if err != nil {
+		return 0, err
+	}
+
+	if to > tip {
+		return 0, fmt.Errorf("can't recompute beyond the stage progress: to=%d, the supply is calculated up to %d", to, tip)
+	}
+
+	applied, err := watchlistApplied(db, cfg.Watchlist)
+	if err != nil {
+		return 0, err
+	}
+	if !applied {
+		return 0, fmt.Errorf("the watchlist isn't the one the stored locked supply is calculated with, use the same --%s as the node", WatchlistFlag.Name)
+	}
+
+	start, totals, err := initialTotals(db, from, cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Info("Recomputing ETH supply", "from", from, "to", to, "calculatedFrom", start)
+
+	changed := 0
+
+	err = calculateForward(db, genesis, start, to, cfg.Watchlist, totals, func(blockNumber uint64, totals *Totals) error {
+		if blockNumber < from {
+			return nil
+		}
+
+		stored, err := readStoredSupply(db, blockNumber)
+		if err != nil {
+			return err
+		}
+
+		keep := storesSupply(blockNumber, tip, cfg)
+		if (keep && stored == nil) || (stored != nil && !stored.Eq(&totals.Supply)) {
+			changed++
+			log.Warn("The recomputed ETH supply differs from the stored one", "block", blockNumber, "supply", totals.Supply.ToBig())
+		}
+
+		// the histogram of the stage progress is kept for the next calculation
+		return setTotalsForBlock(db, blockNumber, totals, blockNumber == tip || storesHistogram(blockNumber, cfg.HistogramInterval))
+	})
+	if err != nil {
+		return changed, err
+	}
+
+	// the issuance is calculated before pruning, like in the stage, so the supply doesn't have to be replayed
+	if err = CalculateIssuance(db, chainConfig, from, to); err != nil {
+		return changed, err
+	}
+
+	for blockNumber := from; blockNumber <= to; blockNumber++ {
+		if storesSupply(blockNumber, tip, cfg) {
+			continue
+		}
+		if err = DeleteSupplyForBlock(db, blockNumber); err != nil {
+			return changed, err
+		}
+	}
+
+	if changed > 0 && to < tip {
+		log.Warn("The blocks after the recomputed range are calculated from the old values, recompute them too if they are wrong", "from", to+1, "to", tip)
+	}
+
+	return changed, nil
+}
+
+// Reset removes all the values stored for the blocks and makes the stage calculate everything from genesis.
+func Reset(db ethdb.Database) error {
+	migrator, ok := db.(ethdb.BucketsMigrator)
+	if !ok {
+		return fmt.Errorf("can't clear the buckets of %T", db)
+	}
+
+	log.Info("Removing all the ETH supply values", "buckets", blockBuckets)
+
+	if err := migrator.ClearBuckets(blockBuckets...); err != nil {
+		return err
+	}
+
+	return resetStage(db)
+}
+
+// readStoredSupply returns the supply stored for the block, `nil` if it isn't stored (pruned) or is stale.
+func readStoredSupply(db ethdb.Getter, blockNumber uint64) (*uint256.Int, error) {
+	enc, err := db.Get(BucketName, keyFromBlockNumber(blockNumber))
+	if err == ethdb.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	supply, err := decodeCanonicalSupply(db, blockNumber, enc)
+	if errors.Is(err, ErrStaleSupply) {
+		return nil, nil
+	}
+	return supply, err
+}
@@ -0,0 +1,193 @@
+package supply
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// expectedSupply is the sum of the balances after the block.
+func (h *syncHarness) expectedSupply(blockNumber uint64) *uint256.Int {
+	supply := uint256.NewInt()
+	for i := range h.states[blockNumber] {
+		supply.Add(supply, &h.states[blockNumber][i].Balance)
+	}
+	return supply
+}
+
+func TestRecompute(t *testing.T) {
+	h := newSyncHarness(t, Config{HistogramInterval: 10, SupplyInterval: 10, SupplyRetention: 5})
+	h.execute(40)
+	h.sync(StrategyForward)
+
+	// a wrong value, a missing checkpoint and a wrong retained block
+	for blockNumber, err := range map[uint64]error{
+		20: SetSupplyForBlock(h.tx, 20, common.Hash{}, uint256.NewInt().SetUint64(1)),
+		30: DeleteSupplyForBlock(h.tx, 30),
+		37: SetSupplyForBlock(h.tx, 37, common.Hash{}, uint256.NewInt().SetUint64(1)),
+	} {
+		if err != nil {
+			t.Fatalf("block %d: %v", blockNumber, err)
+		}
+	}
+
+	changed, err := Recompute(h.tx, nil, params.RinkebyChainConfig, 15, 38, h.cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 3 {
+		t.Errorf("expected 3 changed blocks, got %d", changed)
+	}
+
+	for blockNumber, expected := range map[uint64]*uint256.Int{20: h.expectedSupply(20), 30: h.expectedSupply(30), 37: h.expectedSupply(37)} {
+		if supply, err := readStoredSupply(h.tx, blockNumber); err != nil || supply == nil || !supply.Eq(expected) {
+			t.Errorf("block %d: expected the recomputed supply %d, got %v (%v)", blockNumber, expected, supply, err)
+		}
+	}
+
+	h.check()
+
+	if _, err = Recompute(h.tx, nil, params.RinkebyChainConfig, 30, 41, h.cfg.Config); err == nil {
+		t.Error("expected an error for the blocks after the stage progress")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	h := newSyncHarness(t, Config{})
+	h.execute(20)
+	h.sync(StrategyForward)
+	if err := stages.SaveStageProgress(h.tx, stages.Execution, h.head()); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := uint256.NewInt().SetUint64(1)
+	if err := SetSupplyForBlock(h.tx, 15, common.Hash{}, wrong); err != nil {
+		t.Fatal(err)
+	}
+
+	var blocks []*BlockTotals
+	err := DryRun(h.tx, nil, 10, 20, h.cfg.Config, func(b *BlockTotals) {
+		blocks = append(blocks, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 11 {
+		t.Fatalf("expected 11 blocks, got %d", len(blocks))
+	}
+	for i, b := range blocks {
+		blockNumber := uint64(10 + i)
+		if b.BlockNumber != blockNumber || !b.Totals.Supply.Eq(h.expectedSupply(blockNumber)) {
+			t.Errorf("block %d: %v, expected the supply %d", blockNumber, b, h.expectedSupply(blockNumber))
+		}
+		if blockNumber == 15 && (b.Stored == nil || !b.Stored.Eq(wrong)) {
+			t.Errorf("block 15: expected the stored supply %d, got %v", wrong, b.Stored)
+		}
+	}
+
+	// nothing is written
+	if supply, err := GetSupplyForBlock(h.tx, 15); err != nil || !supply.Eq(wrong) {
+		t.Errorf("expected the stored supply to be kept, got %v (%v)", supply, err)
+	}
+}
+
+// TestDryRunSparse checks that the stored supply of the pruned blocks is the one GetSupplyForBlock replays.
+func TestDryRunSparse(t *testing.T) {
+	h := newSyncHarness(t, Config{SupplyInterval: 10, SupplyRetention: 5})
+	h.execute(40)
+	h.sync(StrategyForward)
+
+	// the blocks after the stage progress don't have the supply
+	h.execute(3)
+	if err := stages.SaveStageProgress(h.tx, stages.Execution, h.head()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pruned blocks after the wrong value are replayed from it
+	wrong := uint256.NewInt().SetUint64(1)
+	if err := SetSupplyForBlock(h.tx, 20, common.Hash{}, wrong); err != nil {
+		t.Fatal(err)
+	}
+
+	var blocks []*BlockTotals
+	err := DryRun(h.tx, nil, 12, h.head(), h.cfg.Config, func(b *BlockTotals) {
+		blocks = append(blocks, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 32 {
+		t.Fatalf("expected 32 blocks, got %d", len(blocks))
+	}
+	for _, b := range blocks {
+		if !b.Totals.Supply.Eq(h.expectedSupply(b.BlockNumber)) {
+			t.Errorf("block %d: supply %d, expected %d", b.BlockNumber, &b.Totals.Supply, h.expectedSupply(b.BlockNumber))
+		}
+
+		expected, err := GetSupplyForBlock(h.tx, b.BlockNumber)
+		if errors.Is(err, ethdb.ErrKeyNotFound) {
+			expected = nil
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if (b.Stored == nil) != (expected == nil) || (expected != nil && !b.Stored.Eq(expected)) {
+			t.Errorf("block %d: expected the stored supply %v, got %v", b.BlockNumber, expected, b.Stored)
+		}
+	}
+
+	if replayed := blocks[25-12].Stored; replayed == nil || replayed.Eq(h.expectedSupply(25)) {
+		t.Errorf("block 25: expected the supply replayed from the wrong value, got %v", replayed)
+	}
+}
+
+func TestReset(t *testing.T) {
+	h := newSyncHarness(t, Config{})
+	h.execute(10)
+	h.sync(StrategyForward)
+
+	snapshot := filepath.Join(t.TempDir(), "balances")
+	if err := ioutil.WriteFile(snapshot, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := &BackwardCheckpoint{From: 1, To: 10, BlockNumber: 5, Snapshot: snapshot}
+	if err := h.tx.Put(CheckpointBucketName, backwardCheckpointKey, encodeBackwardCheckpoint(checkpoint)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Reset(h.tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if progress, err := stages.GetStageProgress(h.tx, StageID); err != nil || progress != 0 {
+		t.Fatalf("expected the stage progress 0, got %d (%v)", progress, err)
+	}
+	for _, bucket := range blockBuckets {
+		if err := h.tx.Walk(bucket, nil, 0, func(k, _ []byte) (bool, error) {
+			t.Errorf("%s: expected the bucket to be empty, got the key %x", bucket, k)
+			return false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if checkpoint, err := ReadBackwardCheckpoint(h.tx); err != nil || checkpoint != nil {
+		t.Errorf("expected the checkpoint to be removed, got %v (%v)", checkpoint, err)
+	}
+	if _, err := os.Stat(snapshot); !os.IsNotExist(err) {
+		t.Errorf("expected the snapshot to be removed, got %v", err)
+	}
+
+	// calculated again from genesis
+	h.sync(StrategyForward)
+	h.check()
+}
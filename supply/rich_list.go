@@ -0,0 +1,209 @@
+package supply
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const RichListBucketName = "org.ffconsulting.tg.db.ETH_RICH_LIST"
+
+// RichListEntry is an account in the rich list.
+type RichListEntry struct {
+	Address common.Address
+	Balance uint256.Int
+}
+
+// RichList is the list of the accounts with the largest balances at a block, sorted by balance (the largest first).
+type RichList struct {
+	// Size is the number of accounts that the list is limited to.
+	// If there are less entries than that, there are no other accounts with non-zero balance.
+	Size    int
+	Entries []RichListEntry
+}
+
+// richListHeap is a min-heap by balance, so the smallest of the top balances is replaced first.
+type richListHeap []RichListEntry
+
+func (h richListHeap) Len() int            { return len(h) }
+func (h richListHeap) Less(i, j int) bool  { return h[i].Balance.Lt(&h[j].Balance) }
+func (h richListHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *richListHeap) Push(x interface{}) { *h = append(*h, x.(RichListEntry)) }
+func (h *richListHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// topBalances returns the `size` largest balances.
+// It keeps only `size` entries in memory, no matter how many balances there are.
+func topBalances(balances forEachBalance, size int) (*RichList, error) {
+	h := make(richListHeap, 0, size)
+
+	err := balances(func(address common.Address, entry *balanceEntry) error {
+		if len(h) < size {
+			top := RichListEntry{Address: address}
+			top.Balance.Set(&entry.balance)
+			heap.Push(&h, top)
+		} else if size > 0 && h[0].Balance.Lt(&entry.balance) {
+			h[0].Address = address
+			h[0].Balance.Set(&entry.balance)
+			heap.Fix(&h, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := &RichList{Size: size, Entries: []RichListEntry(h)}
+	sortRichList(list.Entries)
+	return list, nil
+}
+
+func sortRichList(entries []RichListEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[j].Balance.Lt(&entries[i].Balance)
+	})
+}
+
+// GetRichList returns the `n` accounts with the largest balances at the block.
+// It takes the closest rich list stored at or before the block and replays the account changesets
+// after it: only the accounts that are in that list or that changed since can be in the top,
+// the balances of all other accounts are at most the smallest balance in the stored list.
+// If the stored list isn't enough to tell the top `n` accounts for sure, an error is returned.
+func GetRichList(tx ethdb.Tx, blockNumber uint64, n int) (*RichList, error) {
+	k, v, err := seekAtOrBefore(tx, RichListBucketName, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	storedAt := binary.BigEndian.Uint64(k)
+
+	stored, err := decodeRichList(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > stored.Size {
+		return nil, fmt.Errorf("the rich list is limited to %d accounts", stored.Size)
+	}
+
+	// the accounts that aren't in the stored list have at most that balance
+	threshold := uint256.NewInt()
+	if len(stored.Entries) == stored.Size && stored.Size > 0 {
+		threshold.Set(&stored.Entries[len(stored.Entries)-1].Balance)
+	}
+
+	candidates := make(map[common.Address]*uint256.Int, len(stored.Entries))
+	for i := range stored.Entries {
+		candidates[stored.Entries[i].Address] = &stored.Entries[i].Balance
+	}
+
+	if blockNumber > storedAt {
+		changed := make(map[common.Address]struct{})
+		err = changeset.Walk(ethdb.NewRoTxDb(tx), dbutils.PlainAccountChangeSetBucket, dbutils.EncodeBlockNumber(storedAt+1), 0, func(blockN uint64, k, _ []byte) (bool, error) {
+			if blockN > blockNumber {
+				return false, nil
+			}
+			changed[common.BytesToAddress(k)] = struct{}{}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for address := range changed {
+			enc, err := state.GetAsOf(tx, false, address[:], blockNumber+1)
+			if err != nil && err != ethdb.ErrKeyNotFound {
+				return nil, err
+			}
+
+			acc := &account{}
+			if err = decodeAccount(enc, acc); err != nil {
+				return nil, err
+			}
+			candidates[address] = &acc.balance
+		}
+	}
+
+	list := &RichList{Size: n, Entries: make([]RichListEntry, 0, len(candidates))}
+	for address, balance := range candidates {
+		if balance.IsZero() {
+			continue
+		}
+		entry := RichListEntry{Address: address}
+		entry.Balance.Set(balance)
+		list.Entries = append(list.Entries, entry)
+	}
+	sortRichList(list.Entries)
+
+	if len(list.Entries) > n {
+		list.Entries = list.Entries[:n]
+	}
+
+	if !threshold.IsZero() && (len(list.Entries) < n || list.Entries[len(list.Entries)-1].Balance.Lt(threshold)) {
+		return nil, fmt.Errorf("can't tell the top %d accounts at the block %d from the rich list stored at the block %d, try a smaller number", n, blockNumber, storedAt)
+	}
+
+	return list, nil
+}
+
+// size | (address | balance length | balance)...
+func SetRichListForBlock(db ethdb.Putter, blockNumber uint64, list *RichList) error {
+	value := make([]byte, 8, 8+len(list.Entries)*(common.AddressLength+1+32))
+	binary.BigEndian.PutUint64(value, uint64(list.Size))
+
+	for i := range list.Entries {
+		balanceBytes := list.Entries[i].Balance.Bytes()
+		value = append(value, list.Entries[i].Address[:]...)
+		value = append(value, byte(len(balanceBytes)))
+		value = append(value, balanceBytes...)
+	}
+
+	return db.Put(RichListBucketName, keyFromBlockNumber(blockNumber), value)
+}
+
+func DeleteRichListForBlock(db ethdb.Deleter, blockNumber uint64) error {
+	return db.Delete(RichListBucketName, keyFromBlockNumber(blockNumber), nil)
+}
+
+func decodeRichList(enc []byte) (*RichList, error) {
+	if len(enc) < 8 {
+		return nil, fmt.Errorf("malformed rich list: %x", enc)
+	}
+
+	list := &RichList{Size: int(binary.BigEndian.Uint64(enc))}
+
+	for pos := 8; pos < len(enc); {
+		if len(enc) < pos+common.AddressLength+1 {
+			return nil, fmt.Errorf("malformed rich list: %x", enc)
+		}
+
+		var entry RichListEntry
+		copy(entry.Address[:], enc[pos:])
+		pos += common.AddressLength
+
+		length := int(enc[pos])
+		pos++
+		if length > 32 || len(enc) < pos+length {
+			return nil, fmt.Errorf("malformed rich list: %x", enc)
+		}
+
+		entry.Balance.SetBytes(enc[pos : pos+length])
+		pos += length
+
+		list.Entries = append(list.Entries, entry)
+	}
+
+	return list, nil
+}
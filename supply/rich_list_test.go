@@ -0,0 +1,116 @@
+package supply
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestGetRichList(t *testing.T) {
+	db := newTestChain(t, 200, 20, 500)
+
+	cfg := BackwardConfig{Config: Config{RichListInterval: 50, RichListSize: 30}}
+
+	balances := newBalanceStore(0, "")
+	defer balances.close()
+
+	totals := &Totals{}
+	if err := readCurrentState(db, 200, cfg, balances, totals); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpointer := &backwardCheckpointer{db: db, cfg: cfg, from: 1, to: 200, balances: balances}
+
+	// the top of all the balances at every block
+	expected := make(map[uint64]*RichList)
+	err := replayBackward(db, 1, 200, nil, balances, totals, func(blockNumber uint64, totals *Totals) error {
+		var err error
+		if expected[blockNumber], err = topBalances(balances.forEach, 500); err != nil {
+			return err
+		}
+		return checkpointer.onBlock(blockNumber, totals)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.RwKV().Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for _, blockNumber := range []uint64{1, 20, 50, 77, 150, 199, 200} {
+		list, err := GetRichList(tx, blockNumber, 10)
+		if err != nil {
+			t.Errorf("block %d: %v", blockNumber, err)
+			continue
+		}
+
+		if len(list.Entries) != 10 {
+			t.Errorf("block %d: %d entries, expected 10", blockNumber, len(list.Entries))
+			continue
+		}
+
+		for i, entry := range list.Entries {
+			if want := &expected[blockNumber].Entries[i].Balance; !entry.Balance.Eq(want) {
+				t.Errorf("block %d, entry %d: %x %d, expected %d", blockNumber, i, entry.Address, &entry.Balance, want)
+			}
+		}
+	}
+
+	if _, err = GetRichList(tx, 100, 31); err == nil {
+		t.Error("expected an error for more entries than stored")
+	}
+}
+
+// TestRichListAtTip checks that the forward calculation stores the rich list at the tip once per interval.
+func TestRichListAtTip(t *testing.T) {
+	h := newSyncHarness(t, Config{RichListInterval: 10, RichListSize: 5})
+	tx := h.tx.(ethdb.HasTx).Tx()
+
+	for _, blocks := range []int{15, 3, 4} {
+		h.execute(blocks)
+		h.sync(StrategyForward)
+	}
+
+	var stored []uint64
+	err := h.tx.Walk(RichListBucketName, nil, 0, func(k, _ []byte) (bool, error) {
+		stored = append(stored, binary.BigEndian.Uint64(k))
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || stored[0] != 15 || stored[1] != 22 {
+		t.Errorf("expected the rich lists of the blocks 15 and 22, got %v", stored)
+	}
+
+	// the block 18 is replayed from the block 15
+	for _, blockNumber := range []uint64{15, 18, 22} {
+		var expected []uint256.Int
+		for i := range h.states[blockNumber] {
+			if balance := h.states[blockNumber][i].Balance; !balance.IsZero() {
+				expected = append(expected, balance)
+			}
+		}
+		sort.Slice(expected, func(i, j int) bool { return expected[j].Lt(&expected[i]) })
+
+		list, err := GetRichList(tx, blockNumber, 5)
+		if err != nil {
+			t.Fatalf("block %d: %v", blockNumber, err)
+		}
+		if len(list.Entries) != 5 {
+			t.Fatalf("block %d: %d entries, expected 5", blockNumber, len(list.Entries))
+		}
+		for i := range list.Entries {
+			if !list.Entries[i].Balance.Eq(&expected[i]) {
+				t.Errorf("block %d, entry %d: %d, expected %d", blockNumber, i, &list.Entries[i].Balance, &expected[i])
+			}
+		}
+	}
+}
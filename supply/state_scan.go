@@ -0,0 +1,273 @@
+package supply
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// Config contains the settings of both the forward and the backward calculation.
+type Config struct {
+	// HistogramInterval is how often (in blocks) the balance histogram is stored.
+	// It is stored for the last block of the calculation too, so the next one can continue from it.
+	HistogramInterval uint64
+	// SupplyInterval is how often (in blocks) the supply is kept, 0 or 1 keeps it for every block.
+	// It is kept for every one of the last SupplyRetention blocks before the tip too (see PruneSupply).
+	SupplyInterval  uint64
+	SupplyRetention uint64
+	// BatchSize is how many blocks the stage calculates forward between the commits
+	// of its own transaction, 0 commits once at the end.
+	BatchSize uint64
+	// Watchlist contains the accounts which balances aren't circulating.
+	Watchlist Watchlist
+	// RichListInterval is how often (in blocks) the rich list is stored, 0 disables it.
+	// The backward calculation stores it for the first and the last block of the calculation too.
+	// The forward calculation has the balances of all the accounts only at the tip (in the current state),
+	// so it stores the rich list there when the tip passes the next interval after the last stored one.
+	RichListInterval uint64
+	// RichListSize is the number of accounts in the stored rich lists.
+	RichListSize int
+	// ConcentrationInterval is how often (in blocks) the concentration of the balances is stored, 0 disables it.
+	// The backward calculation stores it for the last block of the calculation too,
+	// the forward calculation stores it at the tip like the rich list.
+	ConcentrationInterval uint64
+}
+
+// BackwardConfig contains the settings of the backward calculation.
+type BackwardConfig struct {
+	Config
+
+	// Workers is the number of goroutines that read the current state in parallel.
+	// Each of them reads its own key range (shard) of the state in a separate read transaction.
+	Workers int
+	// KV is used to open the read transactions for the workers.
+	// If it is nil or there is only 1 worker, the state is read in the stage transaction.
+	KV ethdb.RoKV
+	// CheckpointInterval is how often (in blocks) the progress is saved, 0 disables checkpoints.
+	CheckpointInterval uint64
+	// MemoryBudget is the max memory (in MB) for the account balances, 0 means no limit.
+	// The balances that don't fit are spilled to TmpDir.
+	MemoryBudget int
+	// TmpDir is the directory for the balances snapshots of the checkpoints and the spilled balances.
+	TmpDir string
+	// Commit is called after every saved checkpoint, so the stage can commit it.
+	// If it is nil, everything is written in one transaction.
+	Commit func() error
+}
+
+// errShardStateMismatch means that the state committed to the DB isn't the state the stage is working with.
+var errShardStateMismatch = errors.New("the committed state doesn't match the current state")
+
+// shardCheckInterval is the number of accounts a worker reads between checking if the other workers failed.
+const shardCheckInterval = 10_000
+
+// currentStateBalances iterates the accounts with non-zero balance in the current state,
+// the entry passed to `fn` is reused.
+func currentStateBalances(db ethdb.Getter) forEachBalance {
+	return func(fn func(address common.Address, entry *balanceEntry) error) error {
+		var acc account
+		entry := &balanceEntry{}
+
+		return db.Walk(dbutils.PlainStateBucket, nil, 0, func(k, v []byte) (bool, error) {
+			if !isAccount(k) {
+				// for storage entries we just continue
+				return true, nil
+			}
+
+			if err := decodeAccount(v, &acc); err != nil {
+				return false, err
+			}
+			if acc.balance.IsZero() {
+				return true, nil
+			}
+
+			entry.balance.Set(&acc.balance)
+			entry.contract = acc.hasCode()
+
+			return true, fn(common.BytesToAddress(k), entry)
+		})
+	}
+}
+
+// readCurrentState reads balances of all accounts in the current state (the state at `blockNumber`)
+// into `accountBalances` and adds them to `totals` (the supply and the histogram).
+func readCurrentState(db ethdb.Database, blockNumber uint64, cfg BackwardConfig, accountBalances *balanceStore, totals *Totals) error {
+	throughput, err := ReadThroughput(db)
+	if err != nil {
+		return err
+	}
+
+	// the state doesn't change much since the previous scan
+	scan := newScanProgress(throughput.ScanAccounts)
+
+	if cfg.Workers <= 1 || cfg.KV == nil {
+		return readCurrentStateSequential(db, cfg.Watchlist, accountBalances, totals, scan)
+	}
+
+	err = readCurrentStateSharded(cfg.KV, blockNumber, cfg.Workers, cfg.Watchlist, accountBalances, totals, scan)
+	if errors.Is(err, errShardStateMismatch) {
+		// that happens if the stage transaction has uncommitted changes in the state
+		// the workers can't see them, so we have to read everything in the stage transaction
+		log.Warn("Can't read the current state in parallel, reading it sequentially", "reason", err)
+
+		// some of the workers could've read their accounts already
+		accountBalances.close()
+		*accountBalances = *newBalanceStore(cfg.MemoryBudget, cfg.TmpDir)
+		*totals = Totals{}
+
+		return readCurrentStateSequential(db, cfg.Watchlist, accountBalances, totals, newScanProgress(throughput.ScanAccounts))
+	}
+
+	return err
+}
+
+func readCurrentStateSequential(db ethdb.Database, watchlist Watchlist, accountBalances *balanceStore, totals *Totals, scan *scanProgress) error {
+	return db.Walk(dbutils.PlainStateBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if !isAccount(k) {
+			// for storage entries we just continue
+			return true, nil
+		}
+
+		address := common.BytesToAddress(k)
+
+		err := decodeAccountAndUpdateBalance(v, address, watchlist, accountBalances, totals)
+		if err != nil {
+			return false, err
+		}
+
+		scan.onAccount()
+
+		return true, nil
+	})
+}
+
+// readCurrentStateSharded splits the address space into `workers` key ranges by the first byte of the address
+// and reads each of them in its own goroutine and read transaction.
+// Every worker puts the balances into its own shard of the store and adds them to its own totals,
+// the totals of the shards are combined when all of them are read.
+func readCurrentStateSharded(kv ethdb.RoKV, blockNumber uint64, workers int, watchlist Watchlist, accountBalances *balanceStore, totals *Totals, scan *scanProgress) error {
+	if workers > 256 {
+		workers = 256
+	}
+
+	log.Info("Reading the current state in parallel", "workers", workers)
+
+	shards := accountBalances.shard(workers)
+	shardTotals := make([]Totals, workers)
+
+	quit := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(quit) }) }
+
+	errs := make([]error, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		// [start, end), the last shard doesn't have the upper bound
+		start := []byte{byte(i * 256 / workers)}
+		var end []byte
+		if i < workers-1 {
+			end = []byte{byte((i + 1) * 256 / workers)}
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = readShard(kv, blockNumber, start, end, watchlist, shards[i], &shardTotals[i], scan, quit)
+			if errs[i] != nil {
+				// no need to read the rest of the state
+				stop()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range shardTotals {
+		totals.merge(&shardTotals[i])
+	}
+
+	return nil
+}
+
+// readShard reads the balances of the accounts in the key range [start, end) into `balances` and adds them to `totals`.
+// Every address is in the state only once, so they don't have to be looked up in the store.
+func readShard(kv ethdb.RoKV, blockNumber uint64, start, end []byte, watchlist Watchlist, balances *balanceStore, totals *Totals, scan *scanProgress, quit <-chan struct{}) error {
+	tx, err := kv.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the transaction must see exactly the same state as the stage
+	executionAt, err := stages.GetStageProgress(ethdb.NewRoTxDb(tx), stages.Execution)
+	if err != nil {
+		return err
+	}
+	if executionAt != blockNumber {
+		return errShardStateMismatch
+	}
+
+	c := tx.Cursor(dbutils.PlainStateBucket)
+	defer c.Close()
+
+	var acc account
+	read := 0
+
+	for k, v, err := c.Seek(start); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+
+		if end != nil && bytes.Compare(k, end) >= 0 {
+			break
+		}
+
+		if !isAccount(k) {
+			// for storage entries we just continue
+			continue
+		}
+
+		if read++; read%shardCheckInterval == 0 {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+		}
+
+		if err = decodeAccount(v, &acc); err != nil {
+			return err
+		}
+
+		// accounts without balance aren't stored
+		if acc.balance.IsZero() {
+			continue
+		}
+
+		address := common.BytesToAddress(k)
+		entry := &balanceEntry{contract: acc.hasCode()}
+		entry.balance.Set(&acc.balance)
+
+		if err = balances.put(address, entry); err != nil {
+			return err
+		}
+		totals.add(&entry.balance, entry.contract, watchlist.Contains(address))
+
+		scan.onAccount()
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package supply
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// readBalances reads the current state with readCurrentState and returns the totals and a copy of all the balances.
+func readBalances(t *testing.T, db ethdb.Database, blockNumber uint64, cfg BackwardConfig) (*Totals, map[common.Address]balanceEntry) {
+	t.Helper()
+
+	accountBalances := newBalanceStore(cfg.MemoryBudget, cfg.TmpDir)
+	defer accountBalances.close()
+
+	totals := &Totals{}
+	if err := readCurrentState(db, blockNumber, cfg, accountBalances, totals); err != nil {
+		t.Fatal(err)
+	}
+
+	balances := make(map[common.Address]balanceEntry, accountBalances.len())
+	err := accountBalances.forEach(func(address common.Address, entry *balanceEntry) error {
+		balances[address] = *entry
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != accountBalances.len() {
+		t.Errorf("the store has %d balances, but %d of them are iterated", accountBalances.len(), len(balances))
+	}
+
+	return totals, balances
+}
+
+func compareBalances(t *testing.T, name string, totals, expectedTotals *Totals, balances, expected map[common.Address]balanceEntry) {
+	t.Helper()
+
+	if *totals != *expectedTotals {
+		t.Errorf("%s: totals %+v, expected %+v", name, totals, expectedTotals)
+	}
+
+	if len(balances) != len(expected) {
+		t.Errorf("%s: %d balances, expected %d", name, len(balances), len(expected))
+	}
+	for address, entry := range expected {
+		if balances[address] != entry {
+			t.Errorf("%s: %x: balance %+v, expected %+v", name, address, balances[address], entry)
+		}
+	}
+}
+
+func TestReadCurrentStateSharded(t *testing.T) {
+	db := newTestChain(t, 50, 50, 2000)
+	if err := stages.SaveStageProgress(db, stages.Execution, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTotals, expected := readBalances(t, db, 50, BackwardConfig{Workers: 1, KV: db.RwKV()})
+	if len(expected) == 0 || expectedTotals.ContractSupply.IsZero() {
+		t.Fatalf("the test chain should have both EOAs and contracts, got %+v", expectedTotals)
+	}
+
+	// some of the accounts are locked
+	watchlist := make(Watchlist)
+	for address := range expected {
+		watchlist[address] = struct{}{}
+		if len(watchlist) == 10 {
+			break
+		}
+	}
+
+	cfg := Config{Watchlist: watchlist}
+	expectedTotals, expected = readBalances(t, db, 50, BackwardConfig{Config: cfg, Workers: 1, KV: db.RwKV()})
+	if expectedTotals.LockedSupply.IsZero() {
+		t.Fatal("expected the locked supply")
+	}
+
+	for _, workers := range []int{2, 3, 16, 300} {
+		totals, balances := readBalances(t, db, 50, BackwardConfig{Config: cfg, Workers: workers, KV: db.RwKV()})
+		compareBalances(t, fmt.Sprintf("%d workers", workers), totals, expectedTotals, balances, expected)
+	}
+}
+
+// TestReadCurrentStateShardedMismatch checks that the state is read in the stage transaction
+// if it has uncommitted changes that the workers can't see.
+func TestReadCurrentStateShardedMismatch(t *testing.T) {
+	db := newTestChain(t, 50, 50, 2000)
+	if err := stages.SaveStageProgress(db, stages.Execution, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	committedTotals, _ := readBalances(t, db, 50, BackwardConfig{Workers: 1})
+
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// the block 51 is executed in the stage transaction
+	account := accounts.NewAccount()
+	account.Initialised = true
+	account.Balance.SetUint64(1e18)
+	w := state.NewPlainStateWriter(tx, tx, 51)
+	if err = w.UpdateAccountData(context.Background(), common.Address{1}, &accounts.Account{}, &account); err != nil {
+		t.Fatal(err)
+	}
+	if err = stages.SaveStageProgress(tx, stages.Execution, 51); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTotals, expected := readBalances(t, tx, 51, BackwardConfig{Workers: 1})
+	if !expectedTotals.Supply.Eq(uint256.NewInt().Add(&committedTotals.Supply, &account.Balance)) {
+		t.Fatalf("expected the supply of the block 51 %d + %d, got %d", &committedTotals.Supply, &account.Balance, &expectedTotals.Supply)
+	}
+
+	totals, balances := readBalances(t, tx, 51, BackwardConfig{Workers: 4, KV: db.RwKV()})
+	compareBalances(t, "fallback", totals, expectedTotals, balances, expected)
+}
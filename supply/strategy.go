@@ -0,0 +1,188 @@
+package supply
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+const StatsBucketName = "org.ffconsulting.tg.db.ETH_SUPPLY_STATS"
+
+var throughputKey = []byte("throughput")
+
+// Strategy is the way the supply is calculated.
+type Strategy string
+
+const (
+	// StrategyAuto picks the cheapest strategy based on the measured throughput.
+	StrategyAuto = Strategy("auto")
+	// StrategyForward calculates the supply with CalculateForward.
+	StrategyForward = Strategy("forward")
+	// StrategyBackward calculates the supply with CalculateBackward.
+	StrategyBackward = Strategy("backward")
+)
+
+// ParseStrategy returns the strategy by its name.
+func ParseStrategy(name string) (Strategy, error) {
+	switch strategy := Strategy(name); strategy {
+	case StrategyAuto, StrategyForward, StrategyBackward:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown supply strategy %q, should be one of: %s, %s, %s", name, StrategyAuto, StrategyForward, StrategyBackward)
+	}
+}
+
+// defaultBackwardThreshold is the block gap from which the backward calculation is used
+// until the throughput of both strategies is measured on this machine.
+const defaultBackwardThreshold = 50_000
+
+// throughputDecayBlocks is the number of blocks after which the older measurements are halved,
+// so the recent ones (at the current chain height) matter more.
+const throughputDecayBlocks = 100_000
+
+// Throughput is the measured speed of the supply calculation on this machine.
+type Throughput struct {
+	// ForwardBlocks blocks were calculated forward in ForwardDuration.
+	ForwardBlocks   uint64
+	ForwardDuration time.Duration
+	// ReplayBlocks blocks were calculated backward (applying changesets to the state) in ReplayDuration.
+	ReplayBlocks   uint64
+	ReplayDuration time.Duration
+	// ScanAccounts accounts were read in ScanDuration during the last scan of the current state.
+	ScanAccounts uint64
+	ScanDuration time.Duration
+}
+
+// ForwardBlocksPerSecond returns the speed of the forward calculation, 0 if it is unknown.
+func (t *Throughput) ForwardBlocksPerSecond() float64 {
+	return perSecond(t.ForwardBlocks, t.ForwardDuration)
+}
+
+// ReplayBlocksPerSecond returns the speed of applying changesets in the backward calculation, 0 if it is unknown.
+func (t *Throughput) ReplayBlocksPerSecond() float64 {
+	return perSecond(t.ReplayBlocks, t.ReplayDuration)
+}
+
+// ScanAccountsPerSecond returns the speed of reading the current state, 0 if it is unknown.
+func (t *Throughput) ScanAccountsPerSecond() float64 {
+	return perSecond(t.ScanAccounts, t.ScanDuration)
+}
+
+func (t *Throughput) addForward(blocks uint64, duration time.Duration) {
+	t.ForwardBlocks, t.ForwardDuration = addMeasurement(t.ForwardBlocks, t.ForwardDuration, blocks, duration)
+}
+
+func (t *Throughput) addReplay(blocks uint64, duration time.Duration) {
+	t.ReplayBlocks, t.ReplayDuration = addMeasurement(t.ReplayBlocks, t.ReplayDuration, blocks, duration)
+}
+
+func (t *Throughput) setScan(accounts uint64, duration time.Duration) {
+	// the state changes all the time, so only the last scan matters
+	t.ScanAccounts, t.ScanDuration = accounts, duration
+}
+
+func addMeasurement(total uint64, totalDuration time.Duration, n uint64, duration time.Duration) (uint64, time.Duration) {
+	for total > throughputDecayBlocks {
+		total, totalDuration = total/2, totalDuration/2
+	}
+	return total + n, totalDuration + duration
+}
+
+func perSecond(n uint64, duration time.Duration) float64 {
+	if n == 0 || duration <= 0 {
+		return 0
+	}
+	return float64(n) / duration.Seconds()
+}
+
+// ChooseStrategy picks the cheapest way to calculate the supply for the blocks `from`...`to`
+// where `to` is the block of the current state.
+//
+// The backward calculation has to read the whole current state first (it takes hours on mainnet),
+// but then it is very fast. The forward calculation doesn't require any of that, but it is way slower
+// per block at higher block numbers.
+// So, the cost of the forward calculation is `blocks / forward speed` and the cost of the backward one
+// is `accounts / scan speed + blocks / replay speed`. The speeds are measured on this machine.
+//
+// Until both of the strategies are measured, the backward calculation is used for 50.000 blocks and more.
+// That results for most people in the backward calculation for the genesis sync, and the forward one
+// near the tip.
+func ChooseStrategy(db ethdb.Getter, strategy Strategy, from, to uint64) (Strategy, error) {
+	if strategy != StrategyAuto {
+		return strategy, nil
+	}
+
+	blocks := to - from + 1
+
+	throughput, err := ReadThroughput(db)
+	if err != nil {
+		return "", err
+	}
+
+	forwardSpeed := throughput.ForwardBlocksPerSecond()
+	replaySpeed := throughput.ReplayBlocksPerSecond()
+	scanSpeed := throughput.ScanAccountsPerSecond()
+
+	if forwardSpeed == 0 || replaySpeed == 0 || scanSpeed == 0 {
+		if blocks >= defaultBackwardThreshold {
+			return StrategyBackward, nil
+		}
+		return StrategyForward, nil
+	}
+
+	forwardCost := time.Duration(float64(blocks) / forwardSpeed * float64(time.Second))
+	backwardCost := time.Duration((float64(throughput.ScanAccounts)/scanSpeed + float64(blocks)/replaySpeed) * float64(time.Second))
+
+	log.Info("Estimated ETH supply calculation time", "blocks", blocks, "forward", forwardCost.Round(time.Second), "backward", backwardCost.Round(time.Second))
+
+	if backwardCost < forwardCost {
+		return StrategyBackward, nil
+	}
+	return StrategyForward, nil
+}
+
+// ReadThroughput returns the measured throughput, all of its values are 0 if nothing is measured yet.
+func ReadThroughput(db ethdb.Getter) (*Throughput, error) {
+	enc, err := db.Get(StatsBucketName, throughputKey)
+	if err == ethdb.ErrKeyNotFound {
+		return &Throughput{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(enc) != 6*8 {
+		return nil, fmt.Errorf("malformed supply throughput: %x", enc)
+	}
+
+	return &Throughput{
+		ForwardBlocks:   binary.BigEndian.Uint64(enc[0:]),
+		ForwardDuration: time.Duration(binary.BigEndian.Uint64(enc[8:])),
+		ReplayBlocks:    binary.BigEndian.Uint64(enc[16:]),
+		ReplayDuration:  time.Duration(binary.BigEndian.Uint64(enc[24:])),
+		ScanAccounts:    binary.BigEndian.Uint64(enc[32:]),
+		ScanDuration:    time.Duration(binary.BigEndian.Uint64(enc[40:])),
+	}, nil
+}
+
+// recordThroughput adds a new measurement to the stored throughput.
+func recordThroughput(db ethdb.Database, update func(throughput *Throughput)) error {
+	throughput, err := ReadThroughput(db)
+	if err != nil {
+		return err
+	}
+
+	update(throughput)
+
+	enc := make([]byte, 6*8)
+	binary.BigEndian.PutUint64(enc[0:], throughput.ForwardBlocks)
+	binary.BigEndian.PutUint64(enc[8:], uint64(throughput.ForwardDuration))
+	binary.BigEndian.PutUint64(enc[16:], throughput.ReplayBlocks)
+	binary.BigEndian.PutUint64(enc[24:], uint64(throughput.ReplayDuration))
+	binary.BigEndian.PutUint64(enc[32:], throughput.ScanAccounts)
+	binary.BigEndian.PutUint64(enc[40:], uint64(throughput.ScanDuration))
+
+	return db.Put(StatsBucketName, throughputKey, enc)
+}
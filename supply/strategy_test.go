@@ -0,0 +1,59 @@
+package supply
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChooseStrategy(t *testing.T) {
+	// forward: 100 blocks/s, replay: 10.000 blocks/s, the scan of 1M accounts takes 100s
+	measured := func(throughput *Throughput) {
+		throughput.addForward(1_000, 10*time.Second)
+		throughput.addReplay(10_000, time.Second)
+		throughput.setScan(1_000_000, 100*time.Second)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		throughput func(throughput *Throughput)
+		strategy   Strategy
+		from, to   uint64
+		expected   Strategy
+	}{
+		{name: "no record, below the threshold", strategy: StrategyAuto, from: 1, to: 49_999, expected: StrategyForward},
+		{name: "no record, at the threshold", strategy: StrategyAuto, from: 1, to: 50_000, expected: StrategyBackward},
+		{name: "no record, genesis sync", strategy: StrategyAuto, from: 0, to: 12_000_000, expected: StrategyBackward},
+		{name: "no record, override", strategy: StrategyForward, from: 0, to: 12_000_000, expected: StrategyForward},
+		{name: "only forward measured", throughput: func(throughput *Throughput) {
+			throughput.addForward(1_000, 10*time.Second)
+		}, strategy: StrategyAuto, from: 1, to: 100_000, expected: StrategyBackward},
+		// 10s forward, 100s + 0.1s backward
+		{name: "cost model, near the tip", throughput: measured, strategy: StrategyAuto, from: 1, to: 1_000, expected: StrategyForward},
+		// 1000s forward, 100s + 10s backward
+		{name: "cost model, far from the tip", throughput: measured, strategy: StrategyAuto, from: 1, to: 100_000, expected: StrategyBackward},
+		// 6s forward, 100s + 6s backward, the default threshold doesn't matter
+		{name: "cost model, above the threshold", throughput: func(throughput *Throughput) {
+			throughput.addForward(10_000, time.Second)
+			throughput.addReplay(10_000, time.Second)
+			throughput.setScan(1_000_000, 100*time.Second)
+		}, strategy: StrategyAuto, from: 1, to: 60_000, expected: StrategyForward},
+		{name: "cost model, override", throughput: measured, strategy: StrategyBackward, from: 1, to: 1_000, expected: StrategyBackward},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if tt.throughput != nil {
+				if err := recordThroughput(db, tt.throughput); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			strategy, err := ChooseStrategy(db, tt.strategy, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strategy != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, strategy)
+			}
+		})
+	}
+}
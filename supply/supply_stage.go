@@ -1,11 +1,19 @@
 package supply
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
 
+	"github.com/holiman/uint256"
 	"github.com/urfave/cli"
 )
 
@@ -13,6 +21,24 @@ var (
 	StageID = stages.SyncStage("org.ffconsulting.ETH_SUPPLY.v2")
 )
 
+// NodeStages returns the stages of the ETH supply node: the default turbo-geth stages, the supply stage
+// and the `custom` stages after it (the metrics), together with their unwind order.
+// The unwind stack is LIFO, so the supply and the custom stages are added to the end of the default order:
+// they are unwound first, while the changesets of the unwound blocks still exist (see recomputeUnwindPoint).
+func NodeStages(ctx *cli.Context, custom ...stagedsync.StageBuilder) (stagedsync.StageBuilders, stagedsync.UnwindOrder) {
+	defaultStages := stagedsync.DefaultStages()
+
+	builders := append(defaultStages, SyncStage(ctx))
+	builders = append(builders, custom...)
+
+	unwindOrder := stagedsync.DefaultUnwindOrder()
+	for i := len(defaultStages); i < len(builders); i++ {
+		unwindOrder = append(unwindOrder, i)
+	}
+
+	return builders, unwindOrder
+}
+
 func SyncStage(ctx *cli.Context) stagedsync.StageBuilder {
 	return stagedsync.StageBuilder{
 		ID: StageID,
@@ -21,71 +47,352 @@ func SyncStage(ctx *cli.Context) stagedsync.StageBuilder {
 				ID:          StageID,
 				Description: "Calculate ETH supply",
 				ExecFunc: func(s *stagedsync.StageState, _ stagedsync.Unwinder) error {
-					from := s.BlockNumber
-					currentStateAt, err := s.ExecutionAt(world.TX)
+					cfg, err := BackwardConfigFromContext(ctx, world.DB, world.TmpDir)
 					if err != nil {
 						return err
 					}
 
-					if from > currentStateAt {
-						log.Info("Computing ETH supply... DONE", "from", from, "to", currentStateAt)
-						return nil
+					tx, ownTx, err := beginStageTx(world.TX)
+					if err != nil {
+						return err
 					}
+					if !ownTx {
+						return spawnSupplyStage(ctx, s, tx, world.ChainConfig, cfg, nil)
+					}
+					defer tx.Rollback()
 
-					// pick the most efficient way of calculating ETH supply
-					// backward calculation is way faster but requires about 25 minutes
-					// of reading the current state.
-					// calculating forward doesn't require any of that but it is way slower at
-					// higher block numbers.
-					// So at about 50.000 blocks, it is faster to read the current state and then
-					// quickly calculate supply for everything else.
-					// Lower than that it, it is usually faster to just calculate supply.
-					// This code will result for most people that for genesis sync it will use backward
-					// calculation, and for being near the tip -- forward one.
-					if currentStateAt-from >= 50_000 {
-						log.Info("Computing Eth supply backward", "from", from, "to", currentStateAt)
-						err = CalculateBackward(world.TX, from, currentStateAt)
-					} else {
-						log.Info("Computing Eth supply forward", "from", from, "to", currentStateAt)
-						err = CalculateForward(world.TX, from, currentStateAt)
+					// the stage commits its own transaction in batches, so the progress isn't lost if it is interrupted
+					commit := func() error {
+						return tx.CommitAndBegin(context.Background())
 					}
+					cfg.Commit = commit
 
-					if err != nil {
+					if err = spawnSupplyStage(ctx, s, tx, world.ChainConfig, cfg, commit); err != nil {
 						return err
 					}
-
-					log.Info("ETH supply calculation... DONE. use `tg_getSupply` to get values", "from", from, "to", currentStateAt)
-					return s.DoneAndUpdate(world.TX, currentStateAt)
+					return tx.Commit()
 				},
 
 				UnwindFunc: func(u *stagedsync.UnwindState, s *stagedsync.StageState) error {
-					err := Unwind(world.TX, s.BlockNumber, u.UnwindPoint)
+					tx, ownTx, err := beginStageTx(world.TX)
 					if err != nil {
 						return err
 					}
-					return u.Done(world.TX)
+					if ownTx {
+						defer tx.Rollback()
+					}
+
+					err = Unwind(tx, s.BlockNumber, u.UnwindPoint)
+					if err != nil {
+						return err
+					}
+
+					err = UnwindBackwardCheckpoint(tx, u.UnwindPoint)
+					if err != nil {
+						return err
+					}
+
+					if err = u.Done(tx); err != nil {
+						return err
+					}
+
+					if ownTx {
+						return tx.Commit()
+					}
+					return nil
 				},
 			}
 		},
 	}
 }
 
-func Unwind(db ethdb.Database, from, to uint64) (err error) {
-	if from > to {
-		from, to = to, from
+// beginStageTx returns the transaction of the staged sync if it runs in one.
+// Otherwise, it begins a new transaction that the stage has to commit itself (`ownTx` is true).
+func beginStageTx(db ethdb.Database) (tx ethdb.DbWithPendingMutations, ownTx bool, err error) {
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		return db.(ethdb.DbWithPendingMutations), false, nil
 	}
-	if from == to {
-		// nothing to do here
+
+	tx, err = db.Begin(context.Background(), ethdb.RW)
+	return tx, true, err
+}
+
+// spawnSupplyStage calculates the supply and the issuance up to the current state.
+// If `commit` isn't nil, the forward calculation commits every `cfg.BatchSize` blocks together with
+// the stage progress, and the backward one commits with every checkpoint (see `cfg.Commit`).
+func spawnSupplyStage(ctx *cli.Context, s *stagedsync.StageState, tx ethdb.Database, chainConfig *params.ChainConfig, cfg BackwardConfig, commit func() error) error {
+	from := s.BlockNumber
+
+	reset, err := ApplyWatchlist(tx, cfg.Watchlist)
+	if err != nil {
+		return err
+	}
+	if reset {
+		from = 0
+	}
+
+	currentStateAt, err := s.ExecutionAt(tx)
+	if err != nil {
+		return err
+	}
+
+	if from > currentStateAt {
+		log.Info("Computing ETH supply... DONE", "from", from, "to", currentStateAt)
+		s.Done()
 		return nil
 	}
-	log.Info("removing eth supply entries", "from", from, "to", to)
 
-	for blockNumber := from; blockNumber > to; blockNumber-- {
-		err = DeleteSupplyForBlock(db, blockNumber)
-		if err != nil && err == ethdb.ErrKeyNotFound {
-			log.Warn("no supply entry found for block", "blockNumber", blockNumber)
-			err = nil
+	strategy, err := StrategyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// continue the backward calculation if it was interrupted
+	checkpoint, err := LoadBackwardCheckpoint(tx, currentStateAt)
+	if err != nil {
+		return err
+	}
+
+	if checkpoint != nil && strategy == StrategyForward {
+		log.Warn("Discarding the supply checkpoint, the forward calculation is forced", "block", checkpoint.BlockNumber)
+		if err = DeleteBackwardCheckpoint(tx); err != nil {
+			return err
+		}
+		checkpoint = nil
+	}
+
+	if checkpoint == nil {
+		// pick the most efficient way of calculating ETH supply
+		strategy, err = ChooseStrategy(tx, strategy, from, currentStateAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if checkpoint == nil && strategy == StrategyForward {
+		var genesis *core.Genesis
+		genesis, err = GenesisFromContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		batchSize := cfg.BatchSize
+		if commit == nil {
+			batchSize = 0
+		}
+
+		log.Info("Computing Eth supply forward", "from", from, "to", currentStateAt, "batch", batchSize)
+		err = calculateForwardInBatches(s, tx, genesis, chainConfig, from, currentStateAt, batchSize, cfg.Config, commit)
+	} else {
+		if checkpoint != nil {
+			log.Info("Resuming Eth supply backward from the checkpoint", "block", checkpoint.BlockNumber, "from", checkpoint.From, "to", currentStateAt)
+			err = ResumeBackward(tx, checkpoint, currentStateAt, cfg)
 		} else {
+			log.Info("Computing Eth supply backward", "from", from, "to", currentStateAt)
+			err = CalculateBackward(tx, from, currentStateAt, cfg)
+		}
+		if err == nil {
+			// the stage progress can't move until the backward calculation reaches `from`, its checkpoints are the progress
+			err = finishBatch(s, tx, chainConfig, from, currentStateAt, cfg.Config)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.Done()
+	log.Info("ETH supply calculation... DONE. use `tg_getSupply` to get values", "from", from, "to", currentStateAt)
+	return nil
+}
+
+// calculateForwardInBatches calculates the supply forward for the blocks `from`...`to`.
+// The calculation is split into the batches of `batchSize` blocks (0 means one batch),
+// each of them is committed with the stage progress.
+func calculateForwardInBatches(s *stagedsync.StageState, tx ethdb.Database, genesis *core.Genesis, chainConfig *params.ChainConfig, from, to, batchSize uint64, cfg Config, commit func() error) error {
+	batchFrom, totals, err := initialTotals(tx, from, cfg)
+	if err != nil {
+		return err
+	}
+
+	if batchFrom > 0 {
+		if err = deleteTipHistogram(tx, batchFrom-1, cfg); err != nil {
+			return err
+		}
+	}
+
+	progress := newProgress(StrategyForward, to-batchFrom+1, 10_000)
+	defer progress.finish()
+
+	previousTip := from
+	for {
+		batchTo := to
+		if batchSize > 0 && to-batchFrom >= batchSize {
+			batchTo = batchFrom + batchSize - 1
+		}
+
+		if err = calculateForwardWithProgress(tx, genesis, batchFrom, batchTo, cfg, totals, progress); err != nil {
+			return err
+		}
+
+		if err = finishBatch(s, tx, chainConfig, previousTip, batchTo, cfg); err != nil {
+			return err
+		}
+
+		if batchTo == to {
+			return nil
+		}
+
+		log.Info("Committing the ETH supply", "block", batchTo)
+		if err = commit(); err != nil {
+			return err
+		}
+
+		// the totals of the last block are in memory already, it doesn't have to keep its histogram
+		if err = deleteTipHistogram(tx, batchTo, cfg); err != nil {
+			return err
+		}
+
+		previousTip = batchTo
+		batchFrom = batchTo + 1
+	}
+}
+
+// finishBatch calculates the issuance for the blocks `from`...`to` which supply is calculated,
+// prunes the supply and saves the stage progress. `from` is the previous stage progress.
+func finishBatch(s *stagedsync.StageState, tx ethdb.Database, chainConfig *params.ChainConfig, from, to uint64, cfg Config) error {
+	log.Info("Computing ETH issuance", "from", from, "to", to)
+	if err := CalculateIssuance(tx, chainConfig, from, to); err != nil {
+		return err
+	}
+
+	if err := PruneSupply(tx, from, to, cfg); err != nil {
+		return err
+	}
+
+	return s.Update(tx, to)
+}
+
+// InconsistentSupplyError is returned by Unwind if the stored supply doesn't agree with the stage progress,
+// so the supply can't be unwound safely and has to be calculated again.
+type InconsistentSupplyError struct {
+	// StageProgress is the last block the stage calculated the supply for.
+	StageProgress uint64
+	// BlockNumber is the block with the unexpected supply.
+	BlockNumber uint64
+	Reason      string
+}
+
+func (e *InconsistentSupplyError) Error() string {
+	return fmt.Sprintf("inconsistent ETH supply at the block %d (the stage is at the block %d): %s", e.BlockNumber, e.StageProgress, e.Reason)
+}
+
+// Unwind removes all the values stored for the blocks after `to` up to the block `from` (the stage progress).
+// Before removing anything, it checks that the supply at `to` matches the supply at `from` with the changes
+// of the unwound blocks reverted, and returns *InconsistentSupplyError if it doesn't.
+// The supply at `to` is stored even if it was pruned (see `--supply.interval`), it is the tip after the unwind.
+// The unfinished backward calculation has to be unwound after it (see UnwindBackwardCheckpoint).
+func Unwind(db ethdb.Database, from, to uint64) error {
+	if from <= to {
+		// nothing to do here
+		return nil
+	}
+
+	hasTx, ok := db.(ethdb.HasTx)
+	if !ok || hasTx.Tx() == nil {
+		return fmt.Errorf("should be a transaction, got %T", db)
+	}
+	tx := hasTx.Tx().(ethdb.RwTx)
+
+	supply, err := recomputeUnwindPoint(db, tx, from, to)
+	if err != nil {
+		return err
+	}
+
+	log.Info("removing eth supply and issuance entries", "from", from, "to", to)
+
+	for _, bucket := range blockBuckets {
+		if err = deleteBlocksAfter(tx, bucket, to); err != nil {
+			return err
+		}
+	}
+
+	blockHash, err := rawdb.ReadCanonicalHash(db, to)
+	if err != nil {
+		return err
+	}
+
+	return SetSupplyForBlock(db, to, blockHash, supply)
+}
+
+// recomputeUnwindPoint returns the supply at the block `to` calculated back from the supply at the block `from`
+// and checks that it matches the stored one.
+func recomputeUnwindPoint(db ethdb.Database, tx ethdb.Tx, from, to uint64) (*uint256.Int, error) {
+	// an interrupted backward calculation stores the supply after the stage progress
+	calculatedUpTo := from
+	checkpoint, err := ReadBackwardCheckpoint(db)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint != nil && checkpoint.To > calculatedUpTo {
+		calculatedUpTo = checkpoint.To
+	}
+
+	c := tx.Cursor(BucketName)
+	defer c.Close()
+
+	k, _, err := c.Last()
+	if err != nil {
+		return nil, err
+	}
+	if k != nil && binary.BigEndian.Uint64(k) > calculatedUpTo {
+		return nil, &InconsistentSupplyError{StageProgress: from, BlockNumber: binary.BigEndian.Uint64(k), Reason: "the supply is stored after the stage progress"}
+	}
+
+	enc, err := db.Get(BucketName, keyFromBlockNumber(from))
+	if err == ethdb.ErrKeyNotFound {
+		return nil, &InconsistentSupplyError{StageProgress: from, BlockNumber: from, Reason: "no supply at the stage progress"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	_, expected, err := decodeSupply(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = forEachDelta(db, to+1, from, nil, func(_ uint64, delta *supplyDelta) error {
+		expected.Sub(expected, &delta.increase)
+		expected.Add(expected, &delta.decrease)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := replaySupply(tx, to)
+	if err == ethdb.ErrKeyNotFound {
+		return nil, &InconsistentSupplyError{StageProgress: from, BlockNumber: to, Reason: "no supply at or before the unwind point"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !stored.Eq(expected) {
+		return nil, &InconsistentSupplyError{StageProgress: from, BlockNumber: to, Reason: fmt.Sprintf("the supply is %d, %d is expected from the unwound blocks", stored, expected)}
+	}
+
+	return expected, nil
+}
+
+// deleteBlocksAfter removes the entries after the block `blockNumber` from the bucket keyed by block numbers.
+func deleteBlocksAfter(tx ethdb.RwTx, bucket string, blockNumber uint64) error {
+	c := tx.RwCursor(bucket)
+	defer c.Close()
+
+	for k, _, err := c.Seek(keyFromBlockNumber(blockNumber + 1)); k != nil; k, _, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if err = c.DeleteCurrent(); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,558 @@
+package supply
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+
+	"github.com/urfave/cli"
+)
+
+// syncHarness simulates the execution stage and the supply stage on an in-memory DB:
+// the chain can be extended, reorganized and synced again.
+type syncHarness struct {
+	t   *testing.T
+	db  ethdb.Database
+	tx  ethdb.DbWithPendingMutations
+	cfg BackwardConfig
+	rnd *rand.Rand
+
+	addresses []common.Address
+	// states[n] are the accounts after the block n, genesis is empty
+	states [][]accounts.Account
+}
+
+func newSyncHarness(t *testing.T, cfg Config) *syncHarness {
+	db := newTestDB(t)
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tx.Rollback)
+
+	h := &syncHarness{
+		t:         t,
+		db:        db,
+		tx:        tx,
+		cfg:       BackwardConfig{Config: cfg},
+		rnd:       rand.New(rand.NewSource(1)),
+		addresses: make([]common.Address, 200),
+		states:    [][]accounts.Account{make([]accounts.Account, 200)},
+	}
+	for i := range h.addresses {
+		binary.BigEndian.PutUint64(h.addresses[i][12:], h.rnd.Uint64())
+	}
+	return h
+}
+
+func (h *syncHarness) head() uint64 {
+	return uint64(len(h.states) - 1)
+}
+
+// execute executes `blocks` new blocks, every one of them changes some random accounts.
+func (h *syncHarness) execute(blocks int) {
+	for i := 0; i < blocks; i++ {
+		blockNumber := h.head() + 1
+		w := state.NewPlainStateWriter(h.tx, h.tx, blockNumber)
+
+		accountsState := append([]accounts.Account(nil), h.states[len(h.states)-1]...)
+
+		// an account changes at most once in a block
+		for _, k := range h.rnd.Perm(len(accountsState))[:10] {
+			original := accountsState[k]
+
+			if original.Initialised && h.rnd.Intn(5) == 0 {
+				if err := w.DeleteAccount(context.Background(), h.addresses[k], &original); err != nil {
+					h.t.Fatal(err)
+				}
+				accountsState[k] = accounts.Account{}
+				continue
+			}
+
+			if !original.Initialised {
+				accountsState[k] = accounts.NewAccount()
+				accountsState[k].Initialised = true
+			}
+			accountsState[k].Nonce++
+			accountsState[k].Balance.SetUint64(h.rnd.Uint64() >> uint(h.rnd.Intn(64)))
+
+			if err := w.UpdateAccountData(context.Background(), h.addresses[k], &original, &accountsState[k]); err != nil {
+				h.t.Fatal(err)
+			}
+		}
+
+		if err := w.WriteChangeSets(); err != nil {
+			h.t.Fatal(err)
+		}
+		if err := w.WriteHistory(); err != nil {
+			h.t.Fatal(err)
+		}
+
+		h.states = append(h.states, accountsState)
+	}
+}
+
+// reorg unwinds `depth` blocks: first the supply stage, then the execution (like the staged sync does).
+func (h *syncHarness) reorg(depth int) {
+	unwindPoint := h.head() - uint64(depth)
+
+	progress, err := stages.GetStageProgress(h.tx, StageID)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	if progress > unwindPoint {
+		if err = Unwind(h.tx, progress, unwindPoint); err != nil {
+			h.t.Fatal(err)
+		}
+		if err = UnwindBackwardCheckpoint(h.tx, unwindPoint); err != nil {
+			h.t.Fatal(err)
+		}
+		if err = stages.SaveStageProgress(h.tx, StageID, unwindPoint); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+
+	h.unwindExecution(unwindPoint)
+}
+
+// unwindExecution restores the plain state at the block `unwindPoint` and removes the changesets after it.
+func (h *syncHarness) unwindExecution(unwindPoint uint64) {
+	var err error
+
+	current, restored := h.states[len(h.states)-1], h.states[unwindPoint]
+	for i := range current {
+		if current[i].Initialised == restored[i].Initialised && current[i].Equals(&restored[i]) {
+			continue
+		}
+
+		if !restored[i].Initialised {
+			err = h.tx.Delete(dbutils.PlainStateBucket, h.addresses[i][:], nil)
+		} else {
+			enc := make([]byte, restored[i].EncodingLengthForStorage())
+			restored[i].EncodeForStorage(enc)
+			err = h.tx.Put(dbutils.PlainStateBucket, h.addresses[i][:], enc)
+		}
+		if err != nil {
+			h.t.Fatal(err)
+		}
+	}
+
+	// the history of the unwound blocks, the history index stages do it in the staged sync
+	var unwound [][]byte
+	err = changeset.Walk(h.tx, dbutils.PlainAccountChangeSetBucket, dbutils.EncodeBlockNumber(unwindPoint+1), 0, func(_ uint64, k, _ []byte) (bool, error) {
+		unwound = append(unwound, common.CopyBytes(k))
+		return true, nil
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	for _, k := range unwound {
+		if err = bitmapdb.TruncateRange64(h.tx, dbutils.AccountsHistoryBucket, k, unwindPoint+1); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+
+	if err = changeset.Truncate(h.tx.(ethdb.HasTx).Tx().(ethdb.RwTx), unwindPoint+1); err != nil {
+		h.t.Fatal(err)
+	}
+
+	h.states = h.states[:unwindPoint+1]
+}
+
+// sync runs the supply stage up to the head, like `ExecFunc` of the stage does.
+func (h *syncHarness) sync(strategy Strategy) {
+	from, err := stages.GetStageProgress(h.tx, StageID)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	if strategy == StrategyBackward {
+		err = CalculateBackward(h.tx, from, h.head(), h.cfg)
+	} else {
+		err = CalculateForward(h.tx, nil, from, h.head(), h.cfg.Config)
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	if err = PruneSupply(h.tx, from, h.head(), h.cfg.Config); err != nil {
+		h.t.Fatal(err)
+	}
+
+	if err = stages.SaveStageProgress(h.tx, StageID, h.head()); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// check compares the stored supply with the supply calculated from scratch.
+func (h *syncHarness) check() {
+	expected := make([]uint256.Int, h.head()+1)
+	for blockNumber, accountsState := range h.states {
+		for i := range accountsState {
+			expected[blockNumber].Add(&expected[blockNumber], &accountsState[i].Balance)
+		}
+	}
+
+	// the contents of the bucket
+	var stored []uint64
+	err := h.tx.Walk(BucketName, nil, 0, func(k, v []byte) (bool, error) {
+		blockNumber := binary.BigEndian.Uint64(k)
+		stored = append(stored, blockNumber)
+
+		if blockNumber > h.head() {
+			h.t.Errorf("block %d: the supply is stored after the head %d", blockNumber, h.head())
+		} else if _, supply, err := decodeSupply(v); err != nil {
+			return false, err
+		} else if !supply.Eq(&expected[blockNumber]) {
+			h.t.Errorf("block %d: stored supply %d, expected %d", blockNumber, supply, &expected[blockNumber])
+		}
+		return true, nil
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	// only the blocks that storesSupply keeps are stored; the checkpoints and the head always are.
+	// The retained blocks can be missing after a reorg to a shorter chain: they were pruned
+	// at the higher tip and GetSupplyForBlock replays them.
+	isStored := make(map[uint64]bool, len(stored))
+	for _, blockNumber := range stored {
+		isStored[blockNumber] = true
+		if !storesSupply(blockNumber, h.head(), h.cfg.Config) {
+			h.t.Errorf("head %d: the supply is stored for the pruned block %d", h.head(), blockNumber)
+		}
+	}
+	for blockNumber := uint64(0); blockNumber <= h.head(); blockNumber++ {
+		checkpoint := h.cfg.SupplyInterval <= 1 || blockNumber%h.cfg.SupplyInterval == 0 || blockNumber == h.head()
+		if checkpoint && !isStored[blockNumber] {
+			h.t.Errorf("head %d: the supply isn't stored for the block %d", h.head(), blockNumber)
+		}
+	}
+
+	// the blocks that aren't stored are replayed
+	for blockNumber := range expected {
+		supply, err := GetSupplyForBlock(h.tx, uint64(blockNumber))
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		if !supply.Eq(&expected[blockNumber]) {
+			h.t.Errorf("block %d: supply %d, expected %d", blockNumber, supply, &expected[blockNumber])
+		}
+	}
+}
+
+func TestSyncAndReorg(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"every block", Config{}},
+		{"sparse", Config{SupplyInterval: 10, SupplyRetention: 5}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newSyncHarness(t, tc.cfg)
+
+			steps := []struct {
+				reorg, execute int
+				strategy       Strategy
+			}{
+				{0, 50, StrategyBackward},
+				{0, 7, StrategyForward},
+				// a reorg to a shorter chain
+				{5, 2, StrategyForward},
+				// a reorg to a longer chain
+				{1, 4, StrategyForward},
+				// deep reorgs
+				{20, 20, StrategyForward},
+				{30, 10, StrategyBackward},
+				{0, 25, StrategyForward},
+				// a reorg below the retained blocks to a checkpoint, the calculation continues from the one before it
+				{12, 5, StrategyForward},
+			}
+
+			for _, step := range steps {
+				if step.reorg > 0 {
+					h.reorg(step.reorg)
+				}
+				h.execute(step.execute)
+				h.sync(step.strategy)
+				h.check()
+			}
+		})
+	}
+}
+
+// TestUnwindInStagedSync unwinds the stages of the node in the unwind order of the staged sync.
+func TestUnwindInStagedSync(t *testing.T) {
+	h := newSyncHarness(t, Config{SupplyInterval: 10, SupplyRetention: 5})
+	h.execute(50)
+	h.sync(StrategyForward)
+	if err := stages.SaveStageProgress(h.tx, stages.Execution, h.head()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a custom stage after the supply one, like the metrics
+	customID := stages.SyncStage("org.ffconsulting.TEST")
+	custom := stagedsync.StageBuilder{
+		ID: customID,
+		Build: func(world stagedsync.StageParameters) *stagedsync.Stage {
+			return &stagedsync.Stage{
+				ID:          customID,
+				Description: "Test stage",
+				ExecFunc: func(s *stagedsync.StageState, _ stagedsync.Unwinder) error {
+					s.Done()
+					return nil
+				},
+				UnwindFunc: func(u *stagedsync.UnwindState, _ *stagedsync.StageState) error {
+					return u.Done(world.TX)
+				},
+			}
+		},
+	}
+	if err := stages.SaveStageProgress(h.tx, customID, h.head()); err != nil {
+		t.Fatal(err)
+	}
+
+	builders, unwindOrder := NodeStages(cli.NewContext(nil, flag.NewFlagSet("test", flag.ContinueOnError), nil), custom)
+
+	state, err := stagedsync.New(builders, unwindOrder, stagedsync.OptionalParameters{}).Prepare(
+		nil, params.RinkebyChainConfig, nil, nil, h.db, h.tx, "", ethdb.DefaultStorageMode, t.TempDir(), nil, 0, nil, nil, nil, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the real execution unwind needs the blocks, the harness doesn't have them
+	execution, err := state.StageByID(stages.Execution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execution.UnwindFunc = func(u *stagedsync.UnwindState, _ *stagedsync.StageState) error {
+		h.unwindExecution(u.UnwindPoint)
+		return u.Done(h.tx)
+	}
+
+	var unwound []string
+	state.OnBeforeUnwind(func(id stages.SyncStage) error {
+		unwound = append(unwound, string(id))
+		return nil
+	})
+
+	unwindPoint := h.head() - 20
+	if err = state.UnwindTo(unwindPoint, h.tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the unwind is run, the other stages need the network
+	state.DisableAllStages()
+	if err = state.Run(h.tx, h.tx); err != nil {
+		t.Fatal(err)
+	}
+
+	position := make(map[string]int, len(unwound))
+	for i, id := range unwound {
+		position[id] = i
+	}
+	for _, id := range []stages.SyncStage{StageID, customID} {
+		if i, ok := position[string(id)]; !ok || i > position[string(stages.Execution)] {
+			t.Errorf("expected %s to be unwound before Execution, the unwind order is %v", id, unwound)
+		}
+
+		if progress, err := stages.GetStageProgress(h.tx, id); err != nil || progress != unwindPoint {
+			t.Errorf("%s: expected the stage progress %d, got %d (%v)", id, unwindPoint, progress, err)
+		}
+	}
+	if h.head() != unwindPoint {
+		t.Fatalf("expected the execution to be unwound to %d, the head is %d", unwindPoint, h.head())
+	}
+	h.check()
+
+	// the new chain is calculated from the unwind point
+	h.execute(10)
+	h.sync(StrategyForward)
+	h.check()
+}
+
+func TestCalculateForwardInBatches(t *testing.T) {
+	errCrash := errors.New("crash")
+
+	h := newSyncHarness(t, Config{HistogramInterval: 10, SupplyInterval: 10, SupplyRetention: 5})
+	h.execute(45)
+	if err := h.tx.CommitAndBegin(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stagedsync.StageState{Stage: StageID}
+
+	// every batch is committed with the stage progress
+	var committed []uint64
+	crash := true
+	commit := func() error {
+		progress, err := stages.GetStageProgress(h.tx, StageID)
+		if err != nil {
+			return err
+		}
+		committed = append(committed, progress)
+		if crash && len(committed) == 2 {
+			return errCrash
+		}
+		return h.tx.CommitAndBegin(context.Background())
+	}
+
+	err := calculateForwardInBatches(s, h.tx, nil, params.RinkebyChainConfig, 0, h.head(), 15, h.cfg.Config, commit)
+	if err != errCrash {
+		t.Fatalf("expected the crash, got %v", err)
+	}
+	if len(committed) != 2 || committed[0] != 14 || committed[1] != 29 {
+		t.Fatalf("expected the commits at the blocks 14 and 29, got %v", committed)
+	}
+
+	// only the second batch is lost
+	h.tx.Rollback()
+	tx, err := h.db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tx.Rollback)
+	h.tx = tx
+
+	from, err := stages.GetStageProgress(h.tx, StageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 14 {
+		t.Fatalf("expected the stage progress 14 after the crash, got %d", from)
+	}
+
+	committed, crash = nil, false
+	if err = calculateForwardInBatches(s, h.tx, nil, params.RinkebyChainConfig, from, h.head(), 15, h.cfg.Config, commit); err != nil {
+		t.Fatal(err)
+	}
+	// the last batch isn't committed here, the stage does it
+	if len(committed) != 2 || committed[0] != 28 || committed[1] != 43 {
+		t.Fatalf("expected the commits at the blocks 28 and 43, got %v", committed)
+	}
+
+	if progress, err := stages.GetStageProgress(h.tx, StageID); err != nil || progress != h.head() {
+		t.Fatalf("expected the stage progress %d, got %d (%v)", h.head(), progress, err)
+	}
+	for _, blockNumber := range []uint64{28, 43} {
+		if _, err = GetHistogramForBlock(h.tx, blockNumber); err != ethdb.ErrKeyNotFound {
+			t.Errorf("block %d: expected the histogram of the batch end to be removed, got %v", blockNumber, err)
+		}
+	}
+	h.check()
+}
+
+// newUnwindTestTx stores the values for the blocks from 0 to 20, there are no changesets, so the supply doesn't change.
+func newUnwindTestTx(t *testing.T) ethdb.DbWithPendingMutations {
+	tx, err := newTestDB(t).Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tx.Rollback)
+
+	for blockNumber := uint64(0); blockNumber <= 20; blockNumber++ {
+		totals := &Totals{Holders: blockNumber}
+		totals.Supply.SetUint64(100)
+		if err = setTotalsForBlock(tx, blockNumber, totals, true); err != nil {
+			t.Fatal(err)
+		}
+		if err = SetIssuanceForBlock(tx, blockNumber, &Issuance{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tx
+}
+
+func TestUnwind(t *testing.T) {
+	tx := newUnwindTestTx(t)
+
+	// the supply at the unwind point is pruned
+	if err := DeleteSupplyForBlock(tx, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Unwind(tx, 20, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	for blockNumber := uint64(0); blockNumber <= 20; blockNumber++ {
+		_, supplyErr := tx.Get(BucketName, keyFromBlockNumber(blockNumber))
+		_, holdersErr := GetHolderCountForBlock(tx, blockNumber)
+		_, histogramErr := GetHistogramForBlock(tx, blockNumber)
+		_, issuanceErr := GetIssuanceForBlock(tx, blockNumber)
+
+		for _, err := range []error{supplyErr, holdersErr, histogramErr, issuanceErr} {
+			if blockNumber <= 10 && err != nil {
+				t.Errorf("block %d: expected the values to be kept, got %v", blockNumber, err)
+			} else if blockNumber > 10 && err != ethdb.ErrKeyNotFound {
+				t.Errorf("block %d: expected the values to be removed, got %v", blockNumber, err)
+			}
+		}
+	}
+}
+
+func TestUnwindInconsistent(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		modify      func(tx ethdb.Database) error
+		blockNumber uint64
+	}{
+		{
+			name: "stored after the stage progress",
+			modify: func(tx ethdb.Database) error {
+				return SetSupplyForBlock(tx, 25, common.Hash{}, uint256.NewInt())
+			},
+			blockNumber: 25,
+		},
+		{
+			name: "no supply at the stage progress",
+			modify: func(tx ethdb.Database) error {
+				return DeleteSupplyForBlock(tx, 20)
+			},
+			blockNumber: 20,
+		},
+		{
+			name: "wrong supply at the unwind point",
+			modify: func(tx ethdb.Database) error {
+				return SetSupplyForBlock(tx, 10, common.Hash{}, uint256.NewInt().SetUint64(99))
+			},
+			blockNumber: 10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := newUnwindTestTx(t)
+			if err := tc.modify(tx); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Unwind(tx, 20, 10)
+
+			var inconsistent *InconsistentSupplyError
+			if !errors.As(err, &inconsistent) || inconsistent.BlockNumber != tc.blockNumber || inconsistent.StageProgress != 20 {
+				t.Fatalf("expected an inconsistent supply at the block %d, got %v", tc.blockNumber, err)
+			}
+
+			// nothing is removed
+			if _, err = GetIssuanceForBlock(tx, 20); err != nil {
+				t.Errorf("expected the values to be kept, got %v", err)
+			}
+		})
+	}
+}
@@ -1,36 +1,447 @@
 package supply
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 
 	"github.com/holiman/uint256"
 )
 
+// BucketName contains the supply, every value is the canonical block hash it is calculated for followed by the supply.
 const BucketName = "org.ffconsulting.tg.db.ETH_SUPPLY.v2"
 
-func SetSupplyForBlock(db ethdb.Putter, blockNumber uint64, supply *uint256.Int) error {
-	return db.Put(BucketName, keyFromBlockNumber(blockNumber), supply.Bytes())
+// ContractSupplyBucketName contains the ETH held by the accounts with code.
+const ContractSupplyBucketName = "org.ffconsulting.tg.db.ETH_CONTRACT_SUPPLY"
+
+// Buckets contains all the custom buckets that the supply stage uses.
+// They have to be registered before the DB is opened.
+var Buckets = dbutils.BucketsCfg{
+	BucketName:               {},
+	ContractSupplyBucketName: {},
+	IssuanceBucketName:       {},
+	CheckpointBucketName:     {},
+	StatsBucketName:          {},
+	FormatBucketName:         {},
+	HoldersBucketName:        {},
+	HistogramBucketName:      {},
+	RichListBucketName:       {},
+	ConcentrationBucketName:  {},
+	LockedSupplyBucketName:   {},
+	// the old buckets are opened only if they exist, so they can be migrated
+	legacyBucketName: {IsDeprecated: true},
+}
+
+// ErrStaleSupply means that the supply is calculated for a block that isn't canonical anymore:
+// the chain was reorganized and the supply wasn't unwound.
+var ErrStaleSupply = errors.New("stale ETH supply")
+
+// blockBuckets are the buckets keyed by the block number, Unwind removes the unwound blocks from them.
+var blockBuckets = []string{
+	BucketName,
+	ContractSupplyBucketName,
+	IssuanceBucketName,
+	HoldersBucketName,
+	HistogramBucketName,
+	RichListBucketName,
+	ConcentrationBucketName,
+	LockedSupplyBucketName,
+}
+
+// Totals are the values that the supply calculation tracks for every block.
+type Totals struct {
+	// Supply is the sum of the balances of all the accounts.
+	Supply uint256.Int
+	// Holders is the number of accounts with non-zero balance.
+	Holders uint64
+	// Histogram is the distribution of the non-zero balances.
+	Histogram Histogram
+	// ContractSupply is the sum of the balances of the accounts with code, the rest of the supply is held by EOAs.
+	ContractSupply uint256.Int
+	// LockedSupply is the sum of the balances of the accounts in the watchlist, the rest of the supply is circulating.
+	LockedSupply uint256.Int
+}
+
+// add adds the balance of an account.
+// * contract - the account has code.
+// * locked - the account is in the watchlist.
+func (t *Totals) add(balance *uint256.Int, contract, locked bool) {
+	t.Supply.Add(&t.Supply, balance)
+	if contract {
+		t.ContractSupply.Add(&t.ContractSupply, balance)
+	}
+	if locked {
+		t.LockedSupply.Add(&t.LockedSupply, balance)
+	}
+	t.Histogram.add(balance)
+}
+
+// merge adds the totals of another set of accounts.
+func (t *Totals) merge(other *Totals) {
+	t.Supply.Add(&t.Supply, &other.Supply)
+	t.Holders += other.Holders
+	for i := range t.Histogram {
+		t.Histogram[i] += other.Histogram[i]
+	}
+	t.ContractSupply.Add(&t.ContractSupply, &other.ContractSupply)
+	t.LockedSupply.Add(&t.LockedSupply, &other.LockedSupply)
+}
+
+// remove removes the balance of an account.
+func (t *Totals) remove(balance *uint256.Int, contract, locked bool) {
+	t.Supply.Sub(&t.Supply, balance)
+	if contract {
+		t.ContractSupply.Sub(&t.ContractSupply, balance)
+	}
+	if locked {
+		t.LockedSupply.Sub(&t.LockedSupply, balance)
+	}
+	t.Histogram.remove(balance)
+}
+
+// setTotalsForBlock stores all the values calculated for the block.
+// The histogram is stored only if `withHistogram` is set, it is too big to be stored for every block.
+// The supply is stored for every block, the stage prunes it after calculating the issuance (see PruneSupply).
+func setTotalsForBlock(db ethdb.Database, blockNumber uint64, totals *Totals, withHistogram bool) error {
+	blockHash, err := rawdb.ReadCanonicalHash(db, blockNumber)
+	if err != nil {
+		return err
+	}
+
+	if err = SetSupplyForBlock(db, blockNumber, blockHash, &totals.Supply); err != nil {
+		return err
+	}
+
+	if err := SetHolderCountForBlock(db, blockNumber, totals.Holders); err != nil {
+		return err
+	}
+
+	if err := SetContractSupplyForBlock(db, blockNumber, &totals.ContractSupply); err != nil {
+		return err
+	}
+
+	if err := SetLockedSupplyForBlock(db, blockNumber, &totals.LockedSupply); err != nil {
+		return err
+	}
+
+	if !withHistogram {
+		return nil
+	}
+
+	return SetHistogramForBlock(db, blockNumber, &totals.Histogram)
+}
+
+// storesSupply returns true if the supply is kept for the block when the supply is calculated up to `tip`:
+// every `cfg.SupplyInterval` blocks and every block of the last `cfg.SupplyRetention` ones.
+func storesSupply(blockNumber, tip uint64, cfg Config) bool {
+	return cfg.SupplyInterval <= 1 || blockNumber%cfg.SupplyInterval == 0 || blockNumber+cfg.SupplyRetention >= tip
+}
+
+// PruneSupply removes the supply that isn't kept anymore (see storesSupply) after the supply was calculated
+// from `previousTip` (the stage progress before the calculation) up to `tip`.
+func PruneSupply(db ethdb.Database, previousTip, tip uint64, cfg Config) error {
+	if cfg.SupplyInterval <= 1 {
+		return nil
+	}
+
+	// the blocks that were near the previous tip and the blocks that were calculated again
+	// from the closest one before the previous tip that has the supply stored
+	// (the calculation continues from the block before the previous tip, see initialTotals)
+	from := uint64(0)
+	if previousTip > 0 {
+		from = previousTip - 1 - (previousTip-1)%cfg.SupplyInterval
+	}
+	if previousTip < cfg.SupplyRetention {
+		from = 0
+	} else if previousTip-cfg.SupplyRetention < from {
+		from = previousTip - cfg.SupplyRetention
+	}
+
+	hasTx, ok := db.(ethdb.HasTx)
+	if !ok || hasTx.Tx() == nil {
+		return fmt.Errorf("should be a transaction, got %T", db)
+	}
+
+	c := hasTx.Tx().(ethdb.RwTx).RwCursor(BucketName)
+	defer c.Close()
+
+	for k, _, err := c.Seek(keyFromBlockNumber(from)); k != nil; k, _, err = c.Next() {
+		if err != nil {
+			return err
+		}
+
+		blockNumber := binary.BigEndian.Uint64(k)
+		if blockNumber >= tip {
+			break
+		}
+
+		if !storesSupply(blockNumber, tip, cfg) {
+			if err = c.DeleteCurrent(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetSupplyForBlock stores the supply of the block, `blockHash` is the canonical block it is calculated for.
+func SetSupplyForBlock(db ethdb.Putter, blockNumber uint64, blockHash common.Hash, supply *uint256.Int) error {
+	return db.Put(BucketName, keyFromBlockNumber(blockNumber), encodeSupply(blockHash, supply))
+}
+
+// block hash | supply
+func encodeSupply(blockHash common.Hash, supply *uint256.Int) []byte {
+	supplyBytes := supply.Bytes()
+
+	enc := make([]byte, common.HashLength+len(supplyBytes))
+	copy(enc, blockHash[:])
+	copy(enc[common.HashLength:], supplyBytes)
+	return enc
 }
 
+func decodeSupply(enc []byte) (common.Hash, *uint256.Int, error) {
+	if len(enc) < common.HashLength || len(enc) > common.HashLength+32 {
+		return common.Hash{}, nil, fmt.Errorf("malformed ETH supply: %x", enc)
+	}
+
+	return common.BytesToHash(enc[:common.HashLength]), uint256.NewInt().SetBytes(enc[common.HashLength:]), nil
+}
+
+// decodeCanonicalSupply decodes the supply stored for the block and returns ErrStaleSupply
+// if it is calculated for a block that isn't canonical anymore.
+func decodeCanonicalSupply(db ethdb.Getter, blockNumber uint64, enc []byte) (*uint256.Int, error) {
+	blockHash, supply, err := decodeSupply(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	canonicalHash, err := rawdb.ReadCanonicalHash(db, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockHash != canonicalHash {
+		return nil, fmt.Errorf("%w: the supply of the block %d is calculated for %x, the canonical block is %x", ErrStaleSupply, blockNumber, blockHash, canonicalHash)
+	}
+
+	return supply, nil
+}
+
+// GetSupplyForBlock returns the supply at the block. If it isn't stored (see `--supply.interval`),
+// it is calculated from the closest stored one before the block by replaying the account changesets.
+// It returns ethdb.ErrKeyNotFound if the supply isn't calculated for the block yet
+// and ErrStaleSupply if it is calculated for a block that isn't canonical anymore.
 func GetSupplyForBlock(db ethdb.Getter, blockNumber uint64) (*uint256.Int, error) {
 	bytes, err := db.Get(BucketName, keyFromBlockNumber(blockNumber))
+	if err == nil {
+		return decodeCanonicalSupply(db, blockNumber, bytes)
+	} else if err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+
+	calculatedUpTo, err := stages.GetStageProgress(db, StageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockNumber > calculatedUpTo {
+		return nil, ethdb.ErrKeyNotFound
+	}
+
+	var supply *uint256.Int
+	err = withTx(db, func(tx ethdb.Tx) error {
+		supply, err = replaySupply(tx, blockNumber)
+		return err
+	})
+	return supply, err
+}
+
+// replaySupply calculates the supply at the block from the closest block at or before it that has the supply stored.
+func replaySupply(tx ethdb.Tx, blockNumber uint64) (*uint256.Int, error) {
+	k, v, err := seekAtOrBefore(tx, BucketName, blockNumber)
 	if err != nil {
 		return nil, err
 	}
 
-	supply := uint256.NewInt()
-	supply.SetBytes(bytes)
+	db := ethdb.NewRoTxDb(tx)
+
+	storedAt := binary.BigEndian.Uint64(k)
+	supply, err := decodeCanonicalSupply(db, storedAt, v)
+	if err != nil || storedAt == blockNumber {
+		return supply, err
+	}
+
+	// only the supply is used, so the watchlist doesn't matter
+	err = forEachDelta(db, storedAt+1, blockNumber, nil, func(_ uint64, delta *supplyDelta) error {
+		supply.Add(supply, &delta.increase)
+		supply.Sub(supply, &delta.decrease)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	return supply, nil
 }
 
+// errStopIteration stops the replay in GetSupplyRange when the callback doesn't need more blocks.
+var errStopIteration = errors.New("stop iteration")
+
+// GetSupplyRange calls `fn` with the supply of every block `from`...`to` (inclusive) in order,
+// the same as GetSupplyForBlock returns for each of them. The supply that isn't stored (see `--supply.interval`)
+// is replayed from the previous block, so the changesets of the range are read only once.
+// The iteration stops when `fn` returns false or an error, after the last calculated block,
+// or with ErrStaleSupply at the first block which supply is calculated for a block that isn't canonical anymore.
+func GetSupplyRange(db ethdb.Getter, from, to uint64, fn func(blockNumber uint64, supply *uint256.Int) (bool, error)) error {
+	calculatedUpTo, err := stages.GetStageProgress(db, StageID)
+	if err != nil {
+		return err
+	}
+
+	if to > calculatedUpTo {
+		to = calculatedUpTo
+	}
+	if from > to {
+		return nil
+	}
+
+	err = withTx(db, func(tx ethdb.Tx) error {
+		db := ethdb.NewRoTxDb(tx)
+
+		supply, err := replaySupply(tx, from)
+		if err != nil {
+			return err
+		}
+		if ok, err := fn(from, supply.Clone()); err != nil || !ok {
+			return err
+		}
+
+		replay := func(blockNumber uint64, delta *supplyDelta) error {
+			supply.Add(supply, &delta.increase)
+			supply.Sub(supply, &delta.decrease)
+
+			ok, err := fn(blockNumber, supply.Clone())
+			if err == nil && !ok {
+				err = errStopIteration
+			}
+			return err
+		}
+
+		c := tx.Cursor(BucketName)
+		defer c.Close()
+
+		// the stored blocks and the gaps before them
+		previous := from
+		for k, v, err := c.Seek(keyFromBlockNumber(from + 1)); ; k, v, err = c.Next() {
+			if err != nil {
+				return err
+			}
+
+			storedAt := to + 1
+			if k != nil && binary.BigEndian.Uint64(k) <= to {
+				storedAt = binary.BigEndian.Uint64(k)
+			}
+
+			var stored *uint256.Int
+			if storedAt <= to {
+				if stored, err = decodeCanonicalSupply(db, storedAt, v); err != nil {
+					return err
+				}
+			}
+
+			if storedAt > previous+1 {
+				if err = forEachDelta(db, previous+1, storedAt-1, nil, replay); err != nil {
+					return err
+				}
+			}
+
+			if stored == nil {
+				return nil
+			}
+
+			supply, previous = stored, storedAt
+
+			if ok, err := fn(storedAt, supply.Clone()); err != nil || !ok {
+				return err
+			}
+		}
+	})
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+// withTx calls `fn` with the transaction of the db, or in a new read-only transaction if the db isn't one.
+func withTx(db ethdb.Getter, fn func(tx ethdb.Tx) error) error {
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		return fn(hasTx.Tx())
+	}
+
+	if hasKV, ok := db.(ethdb.HasRwKV); ok {
+		return hasKV.RwKV().View(context.Background(), fn)
+	}
+
+	return fmt.Errorf("can't open a transaction in %T", db)
+}
+
 func DeleteSupplyForBlock(db ethdb.Deleter, blockNumber uint64) error {
 	return db.Delete(BucketName, keyFromBlockNumber(blockNumber), nil)
 }
 
+func SetContractSupplyForBlock(db ethdb.Putter, blockNumber uint64, supply *uint256.Int) error {
+	return db.Put(ContractSupplyBucketName, keyFromBlockNumber(blockNumber), supply.Bytes())
+}
+
+func GetContractSupplyForBlock(db ethdb.Getter, blockNumber uint64) (*uint256.Int, error) {
+	bytes, err := db.Get(ContractSupplyBucketName, keyFromBlockNumber(blockNumber))
+	if err != nil {
+		return nil, err
+	}
+
+	return uint256.NewInt().SetBytes(bytes), nil
+}
+
+func DeleteContractSupplyForBlock(db ethdb.Deleter, blockNumber uint64) error {
+	return db.Delete(ContractSupplyBucketName, keyFromBlockNumber(blockNumber), nil)
+}
+
+// seekAtOrBefore returns the entry of the closest block at or before `blockNumber` in the bucket keyed by block numbers.
+// It returns ethdb.ErrKeyNotFound if there is no such block.
+func seekAtOrBefore(tx ethdb.Tx, bucket string, blockNumber uint64) ([]byte, []byte, error) {
+	c := tx.Cursor(bucket)
+	defer c.Close()
+
+	k, v, err := c.Seek(keyFromBlockNumber(blockNumber))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if k == nil {
+		// all the stored blocks are before `blockNumber`
+		k, v, err = c.Last()
+	} else if binary.BigEndian.Uint64(k) != blockNumber {
+		k, v, err = c.Prev()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if k == nil {
+		return nil, nil, ethdb.ErrKeyNotFound
+	}
+
+	return k, v, nil
+}
+
 func keyFromBlockNumber(blockNumber uint64) []byte {
 	var buffer [8]byte
 	binary.BigEndian.PutUint64(buffer[:], blockNumber)
@@ -55,8 +466,11 @@ func GetInitialPosition(db ethdb.Database, from uint64, initialSupply *uint256.I
 		}
 
 		if initialSupply != nil {
-			initialSupply.Clear()
-			initialSupply.SetBytes(data)
+			_, supply, err := decodeSupply(data)
+			if err != nil {
+				return 0, err
+			}
+			initialSupply.Set(supply)
 		}
 
 		return from, nil
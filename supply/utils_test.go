@@ -0,0 +1,193 @@
+package supply
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestSparseSupply(t *testing.T) {
+	db := newTestChain(t, 100, 20, 500)
+
+	tx, err := db.Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// the test chain starts with no accounts
+	expected := make([]uint256.Int, 101)
+	if err = SetSupplyForBlock(tx, 0, common.Hash{}, &expected[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	err = calculateBackward(tx, 1, 100, BackwardConfig{}, func(blockNumber uint64, totals *Totals) error {
+		expected[blockNumber] = totals.Supply
+		return SetSupplyForBlock(tx, blockNumber, common.Hash{}, &totals.Supply)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = stages.SaveStageProgress(tx, StageID, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{SupplyInterval: 10, SupplyRetention: 5}
+	if err = PruneSupply(tx, 0, 100, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored []uint64
+	err = tx.Walk(BucketName, nil, 0, func(k, _ []byte) (bool, error) {
+		stored = append(stored, binary.BigEndian.Uint64(k))
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStored := []uint64{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 95, 96, 97, 98, 99, 100}
+	if len(stored) != len(expectedStored) {
+		t.Fatalf("stored the supply of the blocks %v, expected %v", stored, expectedStored)
+	}
+	for i := range stored {
+		if stored[i] != expectedStored[i] {
+			t.Fatalf("stored the supply of the blocks %v, expected %v", stored, expectedStored)
+		}
+	}
+
+	// the pruned blocks are replayed from the stored ones
+	for blockNumber := range expected {
+		supply, err := GetSupplyForBlock(tx, uint64(blockNumber))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !supply.Eq(&expected[blockNumber]) {
+			t.Errorf("block %d: supply %d, expected %d", blockNumber, supply, &expected[blockNumber])
+		}
+	}
+
+	if _, err = GetSupplyForBlock(tx, 101); err != ethdb.ErrKeyNotFound {
+		t.Errorf("block 101: expected ErrKeyNotFound, got %v", err)
+	}
+
+	// the range is replayed in one pass, starting both in a gap and at a stored block, up to the stage progress
+	for _, r := range [][2]uint64{{0, 100}, {13, 57}, {90, 200}} {
+		next := r[0]
+		err = GetSupplyRange(tx, r[0], r[1], func(blockNumber uint64, supply *uint256.Int) (bool, error) {
+			if blockNumber != next {
+				t.Fatalf("range %v: got the block %d, expected %d", r, blockNumber, next)
+			}
+			if !supply.Eq(&expected[blockNumber]) {
+				t.Errorf("range %v, block %d: supply %d, expected %d", r, blockNumber, supply, &expected[blockNumber])
+			}
+			// the values belong to the caller
+			supply.Clear()
+			next++
+			return true, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := r[1]
+		if last > 100 {
+			last = 100
+		}
+		if next != last+1 {
+			t.Errorf("range %v: stopped before the block %d, expected after %d", r, next, last)
+		}
+	}
+
+	var count int
+	err = GetSupplyRange(tx, 0, 100, func(uint64, *uint256.Int) (bool, error) {
+		count++
+		return count < 15, nil
+	})
+	if err != nil || count != 15 {
+		t.Errorf("expected to stop after 15 blocks, got %d (%v)", count, err)
+	}
+}
+
+func TestStaleSupply(t *testing.T) {
+	tx, err := newTestDB(t).Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for blockNumber := uint64(0); blockNumber <= 10; blockNumber++ {
+		if err = rawdb.WriteCanonicalHash(tx, common.Hash{byte(blockNumber)}, blockNumber); err != nil {
+			t.Fatal(err)
+		}
+		if err = setTotalsForBlock(tx, blockNumber, &Totals{}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = stages.SaveStageProgress(tx, StageID, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// the block 5 is reorged and the block 6 is replayed from it
+	if err = rawdb.WriteCanonicalHash(tx, common.Hash{0xff}, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteSupplyForBlock(tx, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	for blockNumber, stale := range map[uint64]bool{4: false, 5: true, 6: true, 7: false} {
+		if _, err = GetSupplyForBlock(tx, blockNumber); errors.Is(err, ErrStaleSupply) != stale {
+			t.Errorf("block %d: expected stale %t, got %v", blockNumber, stale, err)
+		}
+	}
+
+	err = GetSupplyRange(tx, 0, 10, func(uint64, *uint256.Int) (bool, error) { return true, nil })
+	if !errors.Is(err, ErrStaleSupply) {
+		t.Errorf("expected ErrStaleSupply from GetSupplyRange, got %v", err)
+	}
+}
+
+func TestAddSupplyBlockHashes(t *testing.T) {
+	tx, err := newTestDB(t).Begin(context.Background(), ethdb.RW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// the format version 6 stores only the supply
+	for blockNumber := uint64(0); blockNumber <= 10; blockNumber++ {
+		if err = rawdb.WriteCanonicalHash(tx, common.Hash{byte(blockNumber)}, blockNumber); err != nil {
+			t.Fatal(err)
+		}
+		if err = tx.Put(BucketName, keyFromBlockNumber(blockNumber), uint256.NewInt().SetUint64(blockNumber*1000).Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = addSupplyBlockHashes(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	for blockNumber := uint64(0); blockNumber <= 10; blockNumber++ {
+		enc, err := tx.Get(BucketName, keyFromBlockNumber(blockNumber))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blockHash, supply, err := decodeSupply(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blockHash != (common.Hash{byte(blockNumber)}) || supply.Uint64() != blockNumber*1000 {
+			t.Errorf("block %d: %x %d, expected %x %d", blockNumber, blockHash, supply, common.Hash{byte(blockNumber)}, blockNumber*1000)
+		}
+	}
+}
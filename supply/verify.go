@@ -0,0 +1,127 @@
+package supply
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// Mismatch is a block where forward and backward calculations or the stored value don't agree.
+type Mismatch struct {
+	BlockNumber uint64
+	Forward     *uint256.Int
+	Backward    *uint256.Int
+	// Stored is the value from `BucketName` (or replayed from the closest stored one),
+	// `nil` if there is no value for this block or it is stale (see ErrStaleSupply)
+	Stored *uint256.Int
+}
+
+func (m *Mismatch) String() string {
+	stored := "<none>"
+	if m.Stored != nil {
+		stored = m.Stored.ToBig().String()
+	}
+	return fmt.Sprintf("block=%d forward=%s backward=%s stored=%s", m.BlockNumber, m.Forward.ToBig().String(), m.Backward.ToBig().String(), stored)
+}
+
+// Verify calculates the ETH supply for blocks `from`...`to` using both forward and backward algorithms
+// and compares the results with each other and with the values stored in `BucketName`.
+// It doesn't write anything, so it can be used with a read-only transaction.
+// `onMismatch` is called for every block where the values differ, the number of such blocks is returned.
+//
+// The backward calculation always starts from the current state, so it takes
+// at least as long as the backward calculation in the stage.
+// The supply it calculates for the range is kept in memory (32 bytes per block).
+func Verify(db ethdb.Database, genesis *core.Genesis, from, to uint64, cfg BackwardConfig, onMismatch func(*Mismatch)) (int, error) {
+	if from > to {
+		from, to = to, from
+	}
+
+	currentStateAt, err := stages.GetStageProgress(db, stages.Execution)
+	if err != nil {
+		return 0, err
+	}
+
+	if to > currentStateAt {
+		return 0, fmt.Errorf("can't verify beyond the current state: to=%d, current state at %d", to, currentStateAt)
+	}
+
+	// the forward calculation needs the supply for the block before `from`
+	// we take it from the backward calculation, so it doesn't depend on the stored values
+	backwardFrom := from
+	if backwardFrom > 0 {
+		backwardFrom--
+	}
+
+	log.Info("Verifying ETH supply: calculating backward", "from", backwardFrom, "to", currentStateAt)
+
+	tip, err := stages.GetStageProgress(db, StageID)
+	if err != nil {
+		return 0, err
+	}
+
+	backward := make([]uint256.Int, to-backwardFrom+1)
+	totals := &Totals{}
+	err = calculateBackward(db, backwardFrom, currentStateAt, cfg, func(blockNumber uint64, backwardTotals *Totals) error {
+		if blockNumber <= to {
+			backward[blockNumber-backwardFrom] = backwardTotals.Supply
+		}
+		if blockNumber == backwardFrom && from > 0 {
+			*totals = *backwardTotals
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Info("Verifying ETH supply: calculating forward", "from", from, "to", to)
+
+	mismatches := 0
+
+	// the stored supply of the previous block, see DryRun
+	var storedSupply *uint256.Int
+	var previousSupply uint256.Int
+
+	err = calculateForward(db, genesis, from, to, cfg.Watchlist, totals, func(blockNumber uint64, forward *Totals) error {
+		forwardSupply := &forward.Supply
+		backwardSupply := &backward[blockNumber-backwardFrom]
+
+		var err error
+		if blockNumber == from {
+			storedSupply, err = GetSupplyForBlock(db, blockNumber)
+			if errors.Is(err, ethdb.ErrKeyNotFound) || errors.Is(err, ErrStaleSupply) {
+				storedSupply, err = nil, nil
+			}
+		} else {
+			storedSupply, err = nextStoredSupply(db, blockNumber, tip, storedSupply, uint256.NewInt().Sub(forwardSupply, &previousSupply))
+		}
+		if err != nil {
+			return err
+		}
+		previousSupply = *forwardSupply
+
+		if forwardSupply.Eq(backwardSupply) && storedSupply != nil && storedSupply.Eq(forwardSupply) {
+			return nil
+		}
+
+		mismatches++
+		onMismatch(&Mismatch{
+			BlockNumber: blockNumber,
+			Forward:     forwardSupply.Clone(),
+			Backward:    backwardSupply.Clone(),
+			Stored:      storedSupply,
+		})
+		return nil
+	})
+	if err != nil {
+		return mismatches, err
+	}
+
+	return mismatches, nil
+}
@@ -0,0 +1,72 @@
+package supply
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+)
+
+func TestVerify(t *testing.T) {
+	h := newSyncHarness(t, Config{SupplyInterval: 10, SupplyRetention: 5})
+	h.execute(40)
+	h.sync(StrategyForward)
+	if err := stages.SaveStageProgress(h.tx, stages.Execution, h.head()); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(from, to uint64) map[uint64]*Mismatch {
+		mismatches := make(map[uint64]*Mismatch)
+		count, err := Verify(h.tx, nil, from, to, h.cfg, func(m *Mismatch) {
+			mismatches[m.BlockNumber] = m
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(mismatches) {
+			t.Errorf("%d mismatches are reported, %d are returned", len(mismatches), count)
+		}
+
+		// both of the calculations are right
+		for blockNumber, m := range mismatches {
+			if !m.Forward.Eq(h.expectedSupply(blockNumber)) || !m.Backward.Eq(h.expectedSupply(blockNumber)) {
+				t.Errorf("block %d: expected the supply %d both ways, got %v", blockNumber, h.expectedSupply(blockNumber), m)
+			}
+		}
+		return mismatches
+	}
+
+	for _, r := range [][2]uint64{{0, 40}, {15, 40}, {12, 13}} {
+		if mismatches := verify(r[0], r[1]); len(mismatches) != 0 {
+			t.Errorf("range %v: expected no mismatches, got %d", r, len(mismatches))
+		}
+	}
+
+	// a wrong value, the pruned blocks after it are replayed from it
+	wrong := uint256.NewInt().SetUint64(1)
+	if err := SetSupplyForBlock(h.tx, 20, common.Hash{}, wrong); err != nil {
+		t.Fatal(err)
+	}
+	// a stale value, it is reported and the verification continues
+	if err := SetSupplyForBlock(h.tx, 30, common.Hash{1}, h.expectedSupply(30)); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches := verify(15, 40)
+	if len(mismatches) != 15 {
+		t.Errorf("expected 15 mismatches, got %d", len(mismatches))
+	}
+	for blockNumber := uint64(20); blockNumber < 30; blockNumber++ {
+		expected := uint256.NewInt().Sub(h.expectedSupply(blockNumber), h.expectedSupply(20))
+		expected.Add(expected, wrong)
+		if m := mismatches[blockNumber]; m == nil || m.Stored == nil || !m.Stored.Eq(expected) {
+			t.Errorf("block %d: expected the stored supply %d, got %v", blockNumber, expected, m)
+		}
+	}
+	for blockNumber := uint64(30); blockNumber < 35; blockNumber++ {
+		if m := mismatches[blockNumber]; m == nil || m.Stored != nil {
+			t.Errorf("block %d: expected no stored supply, got %v", blockNumber, m)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package supply
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// LockedSupplyBucketName contains the ETH held by the accounts in the watchlist.
+const LockedSupplyBucketName = "org.ffconsulting.tg.db.ETH_LOCKED_SUPPLY"
+
+// watchlistKey is the key of the watchlist the locked supply is calculated with in FormatBucketName.
+var watchlistKey = []byte("watchlist")
+
+// Watchlist is the set of accounts which balances don't count as circulating
+// (burn addresses, deposit contracts, foundation wallets, etc).
+// A nil watchlist is empty.
+type Watchlist map[common.Address]struct{}
+
+// Contains returns true if the account is in the watchlist.
+func (w Watchlist) Contains(address common.Address) bool {
+	_, ok := w[address]
+	return ok
+}
+
+// ReadWatchlist reads the watchlist file: one address per line, everything after `#` is a comment.
+//
+//	# burn
+//	0x000000000000000000000000000000000000dEaD
+//	0x00000000219ab540356cBB839Cbe05303d7705Fa # ETH2 deposit contract
+func ReadWatchlist(path string) (Watchlist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	watchlist := make(Watchlist)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if !common.IsHexAddress(text) {
+			return nil, fmt.Errorf("%s:%d: invalid address %q", path, line, text)
+		}
+
+		watchlist[common.HexToAddress(text)] = struct{}{}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return watchlist, nil
+}
+
+// encode returns the sorted addresses of the watchlist.
+func (w Watchlist) encode() []byte {
+	addresses := make([]common.Address, 0, len(w))
+	for address := range w {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
+
+	enc := make([]byte, 0, len(addresses)*common.AddressLength)
+	for _, address := range addresses {
+		enc = append(enc, address[:]...)
+	}
+	return enc
+}
+
+// ApplyWatchlist makes sure that the stored locked supply is calculated with the watchlist.
+// If the watchlist changed, the locked supply is wrong for all the blocks, so the stage is reset
+// to calculate everything again. It returns true if the stage was reset.
+func ApplyWatchlist(db ethdb.Database, watchlist Watchlist) (bool, error) {
+	applied, err := watchlistApplied(db, watchlist)
+	if err != nil || applied {
+		return false, err
+	}
+
+	enc := watchlist.encode()
+	if len(enc) == 0 {
+		err = db.Delete(FormatBucketName, watchlistKey, nil)
+	} else {
+		err = db.Put(FormatBucketName, watchlistKey, enc)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	progress, err := stages.GetStageProgress(db, StageID)
+	if err != nil || progress == 0 {
+		return false, err
+	}
+
+	log.Warn("The supply watchlist changed, the locked supply will be calculated again from genesis", "accounts", len(watchlist))
+
+	return true, resetStage(db)
+}
+
+// watchlistApplied returns true if the stored locked supply is calculated with the watchlist.
+func watchlistApplied(db ethdb.Getter, watchlist Watchlist) (bool, error) {
+	stored, err := db.Get(FormatBucketName, watchlistKey)
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return false, err
+	}
+
+	return bytes.Equal(stored, watchlist.encode()), nil
+}
+
+func SetLockedSupplyForBlock(db ethdb.Putter, blockNumber uint64, supply *uint256.Int) error {
+	return db.Put(LockedSupplyBucketName, keyFromBlockNumber(blockNumber), supply.Bytes())
+}
+
+func GetLockedSupplyForBlock(db ethdb.Getter, blockNumber uint64) (*uint256.Int, error) {
+	bytes, err := db.Get(LockedSupplyBucketName, keyFromBlockNumber(blockNumber))
+	if err != nil {
+		return nil, err
+	}
+
+	return uint256.NewInt().SetBytes(bytes), nil
+}
+
+func DeleteLockedSupplyForBlock(db ethdb.Deleter, blockNumber uint64) error {
+	return db.Delete(LockedSupplyBucketName, keyFromBlockNumber(blockNumber), nil)
+}
@@ -0,0 +1,39 @@
+package supply
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+func TestReadWatchlist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watchlist.txt")
+	err := ioutil.WriteFile(path, []byte(`# burn
+0x000000000000000000000000000000000000dEaD
+
+  0x00000000219ab540356cBB839Cbe05303d7705Fa # ETH2 deposit contract
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watchlist, err := ReadWatchlist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(watchlist) != 2 ||
+		!watchlist.Contains(common.HexToAddress("0x000000000000000000000000000000000000dead")) ||
+		!watchlist.Contains(common.HexToAddress("0x00000000219ab540356cbb839cbe05303d7705fa")) {
+		t.Errorf("unexpected watchlist: %v", watchlist)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("0x1234\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadWatchlist(path); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}